@@ -11,10 +11,10 @@ import (
 	"fmt"
 	"github.com/mgutz/ansi"
 	"github.com/op/go-logging"
+	"io/fs"
 	"io/ioutil"
 	"math/rand"
 	"os"
-	"os/user"
 	"strconv"
 	"strings"
 	"time"
@@ -30,7 +30,7 @@ const (
 	// set during the configuration cascade it will be set by the Load()
 	// command at the end to the value of time.Now().UnixNano()
 	//
-	// Load will set this to the standard random number generator via a
+	// Load, or SeedRandom, will set this to the standard random number generator via a
 	// rand.seed(...) call, so all you need to do for your tests is put
 	// an int in the config file.
 	//
@@ -40,7 +40,8 @@ const (
 
 	// If this key is set at to true at the root level, when Load() is
 	// done it will log the result of the entire configuration cascade
-	// at debug level.
+	// at debug level. Values of keys that look sensitive, see Opts.RedactKeys,
+	// are masked.
 	DUMPCONFIG_KEY = "dumpConfig"
 
 	// If this key is set the root level, whenever the configuration
@@ -94,9 +95,10 @@ var BuildInfo string = ""
 // The Opts type is used to
 type Opts struct {
 	// Name used to search for default config files with. If not specified
-	// it will default ot os.Args[0] which might be "go" if you aren't
-	// running an installed application. If you are using default config
-	// files you probably want to specify this.
+	// Load will default it to os.Args[0] which might be "go" if you aren't
+	// running an installed application, and LoadConfig won't look for
+	// default files at all. If you are using default config files you
+	// probably want to specify this.
 	Name string
 
 	// A prefix used when looking for environment variables to parse as
@@ -104,6 +106,19 @@ type Opts struct {
 	// of the program.
 	EnvPrefix string
 
+	// What separates keys in environment variable names. The default of
+	// "_" is kept for compatibility, but it means keys can't contain an
+	// underscore, so "__" is a better choice for new programs.
+	EnvSeparator string
+
+	// If set environment variable keys match existing keys ignoring case,
+	// and are otherwise lower cased. See EnvMapping.FoldCase.
+	EnvFoldCase bool
+
+	// Environment variables which set a key path no matter what their name
+	// is, such as {"DATABASE_URL": {"db", "url"}}. The prefix isn't needed.
+	EnvBindings map[string][]string
+
 	// A default configuration at the lowest level of precedence. It's
 	// more common to set these defaults using DefaultText, which is
 	// applied after this.
@@ -129,6 +144,26 @@ type Opts struct {
 	DefaultText string
 
 
+	// Where to look for default config files, least important first. If not
+	// set DefaultSearchPaths is used. These are templates which can use
+	// {name} for the Name, {home} for the user's home directory,
+	// {xdg_config_home} for $XDG_CONFIG_HOME (or ~/.config) and
+	// {xdg_config_dirs} for each of the directories in $XDG_CONFIG_DIRS (or
+	// /etc/xdg). A path with wildcards, such as "/etc/{name}.d/*.acl", loads
+	// every matching file in lexical order, so a package that keeps its
+	// config in /etc/<name>/ can use "/etc/{name}/*.acl". Use ListSources()
+	// on the loaded config to see which files were found.
+	SearchPaths []string
+
+	// If set the default files are looked for in this instead of the real
+	// file system, such as an embed.FS with defaults bundled into the
+	// program or a fstest.MapFS in tests. The search paths are used as
+	// names in it without any leading slash, so "/etc/{name}.acl" is
+	// "etc/app.acl", and ones using {home} or the XDG variables are skipped
+	// because nothing is looked up about the host. Files given with
+	// --config still come from the real file system.
+	FS fs.FS
+
 	// If set the default files based on the Name will not be loaded. This
 	// flag can be set via the command line parsing using -i, but if it
 	// is set in the Opts struct during load it can not be re-enabled via
@@ -141,6 +176,24 @@ type Opts struct {
 	// If set os.Args will not be parsed
 	IgnoreCommandLine bool
 
+	// The command line arguments to parse, without the program name. If
+	// nil Load uses os.Args[1:] and LoadConfig uses none.
+	Args []string
+
+	// The environment in the same "KEY=value" form as os.Environ(). It's
+	// used for environment values, profiles, facts, the {home} and XDG
+	// search path variables and env: secrets. If nil Load uses
+	// os.Environ() and LoadConfig uses an empty environment.
+	Environ []string
+
+	// Build information in ACL that overrides everything else. If empty
+	// Load uses the BuildInfo variable and LoadConfig uses nothing.
+	BuildInfo string
+
+	// Called when -h or --help is on the command line. If nil Load uses
+	// the ShowHelp variable, which exits, and LoadConfig ignores them.
+	ShowHelp func()
+
 	// Additional files to load. The ExtrasRequired flag determines if
 	// the files must exist.
 	ExtraFiles []string
@@ -156,9 +209,42 @@ type Opts struct {
 	// can effectively only be created once this allows an application to create
 	// a unique local backed, such as a UI widget, that will receive all log
 	// messages and still preserve the ability to configure other backends
-	// via the configuration infrastructure.
+	// via the configuration infrastructure. They are attached with
+	// AddExtraBackend so they stay in place if logging is configured again.
 	ExtraBackends map[string]logging.Backend
 
+	// What to do when some of the configured logging backends can't be
+	// created. By default a warning is logged for each one and the rest of
+	// the logging configuration is used. See LoggingErrorPolicy.
+	LoggingErrorPolicy LoggingErrorPolicy
+
+	// Profiles from the config to merge over the rest of it, see
+	// PROFILE_KEY. Profiles from <PREFIX>_PROFILE in the environment and
+	// --profile on the command line, which can both be comma separated
+	// lists, are added after these.
+	Profiles []string
+
+	// Facts for if and when blocks in the config on top of DefaultFacts,
+	// which these replace if they have the same name. The hostname and user
+	// aren't looked up if they are given here.
+	Facts map[string]string
+
+	// If set the hostname and user aren't looked up for the facts at all,
+	// so tests don't depend on the machine they run on. Facts can still
+	// give them.
+	IgnoreHostFacts bool
+
+	// Resolvers for secret("scheme:ref") values by scheme, on top of
+	// DefaultSecretResolvers. A resolver here replaces a default one with the
+	// same scheme.
+	SecretResolvers map[string]SecretResolver
+
+	// Glob patterns for keys whose values are masked when the config is
+	// dumped, see StringOpts.RedactKeys. If not set DefaultRedactKeys is
+	// used. Patterns listed under REDACTKEYS_KEY in the config are added to
+	// these, and SensitiveKeys can make them from a tagged struct.
+	RedactKeys []string
+
 	// If set the config will be dumped to the log after parsing is done
 	// the same as if the DUMPCONFIG_KEY was set at the root level. Useful
 	// for when even basic parsing isn't working...
@@ -177,27 +263,159 @@ type Opts struct {
 // because the most common cause is simple the files aren't being used. However, if a
 // file does exist and an error was encountered during parsing, you probably want to
 // know about that. Thus, any parsing errors will end the configuration process
-// and be returned to the caller.
+// and be returned to the caller. Every file and string in the cascade is still
+// parsed first so that all of the errors are returned together.
 //
 // Parsing errors will have a type of ParseLocation which provides further information
-// about the exact error that was encountered.
+// about the exact error that was encountered, or ParseErrors if there was more than
+// one. ParseErrorsOf gives the list either way.
+//
+// Flags on the command line, including any registered with Flag, BoolFlag and
+// Positional, are parsed after the files and environment variables along with
+// any ACL strings given as arguments. See ParseCmdLineArgs.
+//
+// Conditional if and when blocks are evaluated against the facts, see
+// Opts.Facts, once the files are loaded.
+//
+// Profiles selected by Opts.Profiles, the environment or the command line are
+// merged over the config once the files are loaded, before the environment
+// and command line strings. See PROFILE_KEY.
+//
+// Once the cascade is done any secret("scheme:ref") values are resolved, see
+// Opts.SecretResolvers, and Load fails if one of them can't be.
 //
 // After everything else the last thing to be parsed into the config is a string
 // from BuildInfo if set. See that global variable for more information.
 //
+// The cascade itself is done by LoadConfig, with os.Args, os.Environ() and
+// BuildInfo filled in for any of Opts.Args, Opts.Environ and Opts.BuildInfo
+// that aren't set. Libraries and tests that don't want the global side
+// effects below can call LoadConfig directly.
+//
 // Once the configuration is setup, Load() will set the random number generator seed
-// to a value from the key in the constant RANDOMSEED_KEY. See that constant for more.
+// to a value from the key in the constant RANDOMSEED_KEY, using SeedRandom. See that
+// constant for more.
 //
 // At the end of the configuration loading, the logging system from
-// "github.com/op/go-logging" will be configured.  See the documentation for logging.go
+// "github.com/op/go-logging" will be configured by ConfigureLogging.  See the documentation for logging.go
 // for example configuration values that can be used to setup all of the backends
 // supported by that fairly robust package. Any additional logging backends, such as
 // a native UI widget that wants to see all the log output, can be passed to the
-// logging configuratino by setting the ExtraBackends variable.
+// logging configuratino by setting the ExtraBackends variable. If some of the
+// configured backends can't be created the LoggingErrorPolicy decides if that
+// is an error returned from Load or only a warning in the log.
 //
 // Often, a reasonable set of default logging options can be configured using the
 // Default
 func Load(opts *Opts) (*AclNode, error) {
+	// Get us a default options object
+	if opts == nil {
+		opts = &Opts{}
+	}
+
+	// Fill in everything that comes from the process
+	processOpts := *opts
+	if len(processOpts.Name) == 0 {
+		processOpts.Name = os.Args[0]
+	}
+	if processOpts.Args == nil {
+		processOpts.Args = os.Args[1:]
+	}
+	if processOpts.Environ == nil {
+		processOpts.Environ = os.Environ()
+	}
+	if len(processOpts.BuildInfo) == 0 {
+		processOpts.BuildInfo = BuildInfo
+	}
+	if processOpts.ShowHelp == nil {
+		processOpts.ShowHelp = func() { ShowHelp() }
+	}
+
+	cfg, err := LoadConfig(&processOpts)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Name) == 0 {
+		cfg.logDelayed(logging.DEBUG, "Program name = "+processOpts.Name)
+	}
+
+	SeedRandom(cfg)
+
+	err = ConfigureLogging(cfg, &processOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Seeds the global math/rand generator from RANDOMSEED_KEY in the config. If
+// that isn't set the time is used instead and stored in the config so it can
+// be seen in a dump. Returns the seed. Load calls this, but LoadConfig
+// doesn't.
+func SeedRandom(cfg *AclNode) int64 {
+	// Setup random either using a seed from the config or the time. This ensure
+	// that we can both be testable or can have reasonale pseudo-randomness
+	seed := int64(cfg.ChildAsInt(RANDOMSEED_KEY))
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+		cfg.SetValAt(seed, RANDOMSEED_KEY)
+	}
+	cfg.logDelayed(logging.DEBUG, fmt.Sprintf("Random seed is %d", seed))
+	rand.Seed(seed)
+
+	return seed
+}
+
+// Sets up the global logging from the config the way Load does, attaching
+// the Opts.ExtraBackends, following the Opts.LoggingErrorPolicy and dumping
+// the config if asked to. The only error is from a LOGGING_ERRORS_FAIL
+// policy. opts can be nil.
+func ConfigureLogging(cfg *AclNode, opts *Opts) error {
+	if opts == nil {
+		opts = &Opts{}
+	}
+
+	for name, be := range opts.ExtraBackends {
+		AddExtraBackend(name, be)
+	}
+
+	err := SetLoggingConfigWithPolicy(cfg, opts.LoggingErrorPolicy)
+	if err != nil && opts.LoggingErrorPolicy == LOGGING_ERRORS_FAIL {
+		return err
+	}
+
+	if cfg.ChildAsBool(DUMPCONFIG_KEY) || opts.DumpConfig {
+		outputDelayedLog(alog, cfg.LoadMessages())
+		redactKeys := opts.RedactKeys
+		if redactKeys == nil {
+			redactKeys = DefaultRedactKeys
+		}
+		redactKeys = append(redactKeys[:len(redactKeys):len(redactKeys)], cfg.ChildAsStringList(REDACTKEYS_KEY)...)
+
+		var buf bytes.Buffer
+		cfg.StringToWithOpts(bufio.NewWriter(&buf), &StringOpts{
+			Indent:     "\t",
+			Color:      cfg.ChildAsBool(DUMPCOLOR_KEY),
+			RedactKeys: redactKeys,
+		})
+		alog.Debug("Canonical config after all parsing:")
+		alog.Debug(buf.String())
+	}
+
+	return nil
+}
+
+// Does the same configuration cascade as Load but without touching anything
+// global, so it's safe for libraries and parallel tests. Nothing is read from
+// the process: the command line comes only from Opts.Args, the environment
+// only from Opts.Environ and build info only from Opts.BuildInfo, and
+// without a Name no default files are loaded. The random number generator
+// isn't seeded and logging isn't configured, see SeedRandom and
+// ConfigureLogging for those. Messages about the cascade, such as files
+// that couldn't be opened, are kept on the returned root, see LoadMessages,
+// and -h or --help only calls Opts.ShowHelp if it's set.
+func LoadConfig(opts *Opts) (*AclNode, error) {
 
 	var err error
 
@@ -209,48 +427,48 @@ func Load(opts *Opts) (*AclNode, error) {
 	//fmt.Printf("Opts = %v", opts)
 
 	programName := opts.Name
-	if len(programName) == 0 {
-		programName = os.Args[0]
-
-		logDelayed(logging.DEBUG, "Program name = " + programName)
-	}
 
-	// Start with a base configuration passed in from the user if any
-	cfg := opts.Defaults
-	if cfg == nil {
-		cfg = NewAclNode()
-	}
+	// Start with a base configuration passed in from the user if any. It's
+	// copied so the caller's node isn't changed.
+	cfg := opts.Defaults.Duplicate()
+	cfg.collectMessages = true
 
 	if opts.AddColorConsoleLogging {
 		cfg.ParseString(COLOR_LOGGING_ACL, nil)
 	}
 
+	// Parse errors from every step are collected so that they can all be
+	// reported at once after everything has been parsed
+	var parseErrs ParseErrors
+
 	if len(opts.DefaultText) > 0 {
 		location := &ParseLocation{
 			Filename: "DefaultText",
 		}
-		err = cfg.ParseString(opts.DefaultText, location)
-		if err != nil {
-			return nil, err
-		}
+		parseErrs.add(cfg.ParseString(opts.DefaultText, location))
 	}
 
 	// Have to read the command line to see if we are going to ignore defaults or not
 	ignoreDefaults := opts.IgnoreDefaultFiles
 	filesToLoad := make([]string, 0)
 	stringsToParse := make([]string, 0)
+	var clProfiles []string
 
 	// Parse the command line arguments
 	if !opts.IgnoreCommandLine {
-		clIgnore, clFilenames, clStrings := ParseCmdLine()
+		cl := parseCommandLine(opts.Args, cfg.logDelayed)
+		if cl.Help && opts.ShowHelp != nil {
+			opts.ShowHelp()
+		}
 
 		// If options say ignore, then ignore, otherwise go with the command line
 		if !ignoreDefaults {
-			ignoreDefaults = clIgnore
+			ignoreDefaults = cl.Ignore
 		}
 
-		filesToLoad = append(filesToLoad, clFilenames...)
-		stringsToParse = append(stringsToParse, clStrings...)
+		filesToLoad = append(filesToLoad, cl.Filenames...)
+		stringsToParse = append(stringsToParse, cl.Strings...)
+		clProfiles = cl.Profiles
 	}
 
 
@@ -258,56 +476,75 @@ func Load(opts *Opts) (*AclNode, error) {
 	// ParseLocation that means the file existed, and could be loaded, but was
 	// whacky town. We want to let the caller know about that rather tha swallowing
 	// these sorts of things.
+	if len(programName) == 0 {
+		// Without a name there's nothing to look for
+		ignoreDefaults = true
+	}
 	if !ignoreDefaults {
-		// Start with the default files
-		err = cfg.ParseFile("/etc/" + programName + ".acl")
-		if pl, ok := err.(*ParseLocation); ok {
-			return nil, pl
-		}
-
-		// In 1.12 this works, but not in 1.10
-		// dir,err := os.UserHomeDir()
-
-		// 1.10 style of getting the user's home dir
-		current, err := user.Current()
-		if err != nil {
-			return nil, err
-		}
-		dir := current.HomeDir
-		
-		err = cfg.ParseFile(dir + "/." + programName + ".acl")
-		if pl, ok := err.(*ParseLocation); ok {
-			return nil, pl
+		searchPaths := opts.SearchPaths
+		if len(searchPaths) == 0 {
+			searchPaths = DefaultSearchPaths
 		}
 
-		err = cfg.ParseFile("./" + programName + ".acl")
-		if pl, ok := err.(*ParseLocation); ok {
-			return nil, pl
-		}
+		parseErrs.add(loadSearchPaths(cfg, searchPaths, programName, opts.FS, opts.Environ))
 	}
 
 	// Load any files we found on the command like
 	for _, fname := range filesToLoad {
-		err = cfg.ParseFile(fname)
-		if pl, ok := err.(*ParseLocation); ok {
-			return nil, pl
-		}
+		parseErrs.add(loadSource(cfg, nil, fname))
 	}
 
-	// Environment variables
+	// Conditional blocks from the files, including ones inside profiles.
+	// The host isn't looked at for facts given in the options.
+	facts := hostFacts(opts.Environ, opts.Facts, !opts.IgnoreHostFacts)
+	err = cfg.ApplyConditions(facts)
+	if err != nil {
+		return nil, err
+	}
+
+	envPrefix := opts.EnvPrefix
+	if envPrefix == "" {
+		envPrefix = programName
+	}
+	// The prefix is often the lower case program name, so the upper case
+	// version of the profile variable works too
+	profileVars := []string{envPrefix + "_PROFILE", strings.ToUpper(envPrefix) + "_PROFILE"}
+
+	// Profiles are merged over the files, but the environment and command
+	// line still have the last word
+	var envProfiles []string
 	if !opts.IgnoreEnvironment {
-		prefix := opts.EnvPrefix
-		if prefix == "" {
-			prefix = programName
+		for _, name := range profileVars {
+			if v, ok := lookupEnv(opts.Environ, name); ok {
+				envProfiles = append(envProfiles, v)
+			}
 		}
+	}
+	profiles := splitProfiles(opts.Profiles, envProfiles, clProfiles)
+	if len(profiles) > 0 {
+		cfg.logDelayed(logging.DEBUG, "Using profiles "+strings.Join(profiles, ", "))
+	}
+	// This also drops the profiles that weren't selected
+	err = cfg.ApplyProfiles(profiles...)
+	if err != nil {
+		cfg.logDelayed(logging.WARNING, err.Error())
+	}
 
+	// Environment variables
+	if !opts.IgnoreEnvironment {
 		env := make([]string, 0)
-		for _, v := range os.Environ() {
-			if strings.HasPrefix(v, prefix+"_") {
-				env = append(env, v[len(prefix)+1:])
+		for _, v := range opts.Environ {
+			if !strings.HasPrefix(v, profileVars[0]+"=") && !strings.HasPrefix(v, profileVars[1]+"=") {
+				env = append(env, v)
 			}
 		}
-		cfg.ParseEnviron(env)
+
+		cfg.ParseEnvironWith(env, &EnvMapping{
+			Prefix:    envPrefix,
+			Separator: opts.EnvSeparator,
+			FoldCase:  opts.EnvFoldCase,
+			Bindings:  opts.EnvBindings,
+		})
 	}
 
 	// Command line strings
@@ -315,98 +552,57 @@ func Load(opts *Opts) (*AclNode, error) {
 		location := &ParseLocation{
 			Filename: fmt.Sprintf("CMDLINE(%d)", ix),
 		}
-		cfg.ParseString(str, location)
+		err = cfg.ParseString(str, location)
+		if err != nil {
+			cfg.logDelayed(logging.ERROR, err.Error())
+			parseErrs.add(err)
+		}
 	}
 
 	// Possibly add some build info
-	if len(BuildInfo) > 0 {
+	if len(opts.BuildInfo) > 0 {
+		location := &ParseLocation{
+			Filename: "BuildInfo",
+		}
 		bi := NewAclNode()
-		_ = bi.ParseString(BuildInfo, nil) // TODO - handle the error
+		err = bi.ParseString(opts.BuildInfo, location)
+		if err != nil {
+			cfg.logDelayed(logging.ERROR, err.Error())
+			parseErrs.add(err)
+		}
 		//cfg.Children[BUILDINFO_KEY] = bi
 		cfg.SetValAt(bi, BUILDINFO_KEY)
 	}
 
-	// Setup random either using a seed from the config or the time. This ensure
-	// that we can both be testable or can have reasonale pseudo-randomness
-	seed := int64(cfg.ChildAsInt(RANDOMSEED_KEY))
-	if seed == 0 {
-		seed = time.Now().UnixNano()
-		cfg.SetValAt(seed, RANDOMSEED_KEY)
+	if len(parseErrs) > 0 {
+		return nil, parseErrs.err()
 	}
-	logDelayed(logging.DEBUG, fmt.Sprintf("Random seed is %d", seed))
-	rand.Seed(seed)
 
-	SetLoggingConfig(cfg)
+	// The environment and command line could have conditionals too
+	err = cfg.ApplyConditions(facts)
+	if err != nil {
+		return nil, err
+	}
 
-	if cfg.ChildAsBool(DUMPCONFIG_KEY) || opts.DumpConfig {
-		outputDelayedLog(alog)
-		alog.Debug("Canonical config after all parsing:")
-		if cfg.ChildAsBool(DUMPCOLOR_KEY) {
-			alog.Debug(cfg.ColoredString())
-		} else {
-			alog.Debug(cfg.String())
-		}
+	// Secrets are resolved once everything has had a chance to set them
+	resolvers := map[string]SecretResolver{
+		"env": envSecretResolver(opts.Environ),
+	}
+	for scheme, resolver := range opts.SecretResolvers {
+		resolvers[scheme] = resolver
+	}
+	err = cfg.ResolveSecrets(resolvers)
+	if err != nil {
+		return nil, err
 	}
 
 	return cfg, nil
 }
 
-const (
-	clStart = iota
-	clConfigFilename
-)
-
+// Parses os.Args for the flags described in ParseCmdLineArgs. This is what
+// Load uses unless Opts.IgnoreCommandLine is set.
 func ParseCmdLine() (ignore bool, filenames []string, toParse []string) {
-
-	state := clStart
-
-	ignore = false
-	filenames = make([]string, 0)
-	toParse = make([]string, 0)
-
-	args := os.Args[1:]
-	for _, arg := range args {
-		switch state {
-		case clStart:
-			if len(arg) == 0 {
-				continue
-			}
-			if arg[0] == '-' {
-				arg = arg[1:]
-				if arg[0] == '-' {
-					arg = arg[1:]
-				}
-
-				if arg == "c" || arg == "config" {
-					// The next arg is the filename
-					state = clConfigFilename
-					continue
-				}
-
-				if arg == "i" || arg == "ignore" {
-					ignore = true
-					continue
-				}
-
-				logDelayed(logging.ERROR, "Unrecognized command line argument '"+arg+"'")
-			} else {
-				// Store it as a string to parse after all files are loaded
-				toParse = append(toParse, arg)
-			}
-
-		case clConfigFilename:
-			if len(arg) == 0 {
-				// Whatever
-				continue
-			}
-			filenames = append(filenames, arg)
-			state = clStart
-		}
-	}
-
-	// fmt.Printf("Command line parsing ignore=%v  files=%v   toParse=%v", ignore, filenames, toParse)
-	// panic("Stop")
-	return
+	return ParseCmdLineArgs(os.Args[1:])
 }
 
 // An AclNode represents a node in a tree of configuration values that is
@@ -425,6 +621,17 @@ type AclNode struct {
 	OrderedChildNames []string
 	IsMultiline       bool
 	UsesEquals        bool
+
+	// The files Load looked at, only set on the root
+	sources []Source
+
+	// Messages from loading, only kept on a root from LoadConfig
+	messages        []LoadMessage
+	collectMessages bool
+
+	// Set when the node was named with a reset key, as in "!key", so that
+	// Merge can replace rather than add to an existing node
+	reset bool
 }
 
 func NewAclNode() (node *AclNode) {
@@ -439,8 +646,8 @@ func NewAclNode() (node *AclNode) {
 }
 
 // Attempts to load and parse the named file. If syntax errors occuring during
-// the parsing, the error will be of type ParseLocation. Any other type is
-// indicative of a issue loading the file.
+// the parsing, the error will be of type ParseLocation, or ParseErrors if
+// there are several. Any other type is indicative of a issue loading the file.
 func (node *AclNode) ParseFile(filename string) error {
 	// fmt.Printf("ParseFile(%v)\n", filename)
 	data, err := ioutil.ReadFile(filename)
@@ -448,7 +655,7 @@ func (node *AclNode) ParseFile(filename string) error {
 	// fmt.Printf(" len(data)=%d  err=%v\n", len(data), err)
 
 	if err != nil {
-		logDelayed(logging.NOTICE, "Could not open file "+filename)
+		node.logDelayed(logging.NOTICE, "Could not open file "+filename)
 		return err
 	}
 
@@ -457,12 +664,14 @@ func (node *AclNode) ParseFile(filename string) error {
 	}
 	err = node.ParseString(string(data), location)
 	if err != nil {
-		logDelayed(logging.ERROR, err.Error())
+		node.logDelayed(logging.ERROR, err.Error())
 	}
 
 	return err
 }
 
+// Sets string values from KEY=value pairs, splitting the keys on every
+// underscore. See ParseEnvironWith for the more flexible mapping Load uses.
 func (node *AclNode) ParseEnviron(env []string) {
 	for _, e := range env {
 		v := strings.SplitN(e, "=", 2)
@@ -551,8 +760,7 @@ func (node *AclNode) ChildAsStringList(names ...string) []string {
 	}
 	out := make([]string, len(cNode.Values))
 	for ix, v := range cNode.Values {
-		s := v.(string)
-		out[ix] = s
+		out[ix] = valAsString(v)
 	}
 	return out
 }
@@ -703,6 +911,15 @@ func (node *AclNode) findValIx(ix int) int {
 }
 
 func valAsInt(v interface{}) int {
+	// A resolved secret is text, so it's parsed like AsString would see it
+	if secret, ok := v.(Secret); ok {
+		r, err := strconv.ParseInt(strings.TrimSpace(string(secret)), 0, 0)
+		if err != nil {
+			return 0
+		}
+		return int(r)
+	}
+
 	r, ok := v.(int64)
 	if !ok {
 		r, ok := v.(int32)
@@ -728,6 +945,14 @@ func (node *AclNode) AsIntN(ix int) int {
 }
 
 func valAsFloat(v interface{}) float64 {
+	if secret, ok := v.(Secret); ok {
+		r, err := strconv.ParseFloat(strings.TrimSpace(string(secret)), 64)
+		if err != nil {
+			return 0
+		}
+		return r
+	}
+
 	r, ok := v.(float64)
 	if !ok {
 		r, ok := v.(float32)
@@ -752,6 +977,10 @@ func (node *AclNode) AsFloatN(ix int) float64 {
 }
 
 func valAsString(v interface{}) string {
+	if secret, ok := v.(Secret); ok {
+		return string(secret)
+	}
+
 	r, ok := v.(string)
 	if !ok {
 		r, ok := v.(fmt.Stringer)
@@ -786,6 +1015,11 @@ func (node *AclNode) AsStringN(ix int) string {
 }
 
 func valAsBool(v interface{}) bool {
+	// Secret is a Stringer that masks itself, so it has to be caught first
+	if secret, ok := v.(Secret); ok {
+		v = string(secret)
+	}
+
 	r, ok := v.(bool)
 	if !ok {
 		r, ok := v.(string)
@@ -863,7 +1097,8 @@ func (node *AclNode) SetValAt(v interface{}, names ...string) error {
 	return nil
 }
 
-// TODO: This REALLY needs to be optimized, but for now if it will work...
+// Makes a deep copy of the node. This used to go through String() but that
+// would lose the value of any secrets because they are masked.
 func (node *AclNode) Duplicate() *AclNode {
 	next := NewAclNode()
 
@@ -872,59 +1107,87 @@ func (node *AclNode) Duplicate() *AclNode {
 		return next
 	}
 
-	str := node.String()
-	next.ParseString(str, nil)
-	// ignoring all sorts of error conditions...
+	for _, v := range node.Values {
+		if n, ok := v.(*AclNode); ok {
+			v = n.Duplicate()
+		} else if ref, ok := v.(*SecretRef); ok {
+			v = &SecretRef{Ref: ref.Ref}
+		}
+		next.Values = append(next.Values, v)
+	}
+
+	for _, name := range node.OrderedChildNames {
+		if child, ok := node.Children[name]; ok {
+			next.Children[name] = child.Duplicate()
+			next.OrderedChildNames = append(next.OrderedChildNames, name)
+		}
+	}
+	next.IsMultiline = node.IsMultiline
+	next.UsesEquals = node.UsesEquals
+	next.reset = node.reset
+
 	return next
 }
 
 //////////////////////////////////////////////////////
 
-func (node *AclNode) valueTo(writer *bufio.Writer, indentStr string, level int, withColor bool, value interface{}) {
+func (node *AclNode) valueTo(writer *bufio.Writer, level int, path []string, opts *StringOpts, value interface{}) {
 
 	switch v := value.(type) {
 	case *AclNode:
 		//alog.Info("Value is AclNode")
-		v.StringTo(writer, indentStr, level, withColor)
+		v.stringTo(writer, level, path, opts)
 
 	case string:
-		if withColor {
+		if opts.Color {
 			writer.WriteString(ansi.Black)
 		}
 		writer.WriteString(strconv.Quote(v))
 
+	case Secret:
+		if opts.Color {
+			writer.WriteString(ansi.Yellow)
+		}
+		writer.WriteString(strconv.Quote(MASKED_VALUE))
+
+	case *SecretRef:
+		if opts.Color {
+			writer.WriteString(ansi.Yellow)
+		}
+		writer.WriteString(v.String())
+
 	case int:
-		if withColor {
+		if opts.Color {
 			writer.WriteString(ansi.Red)
 		}
 		writer.WriteString(strconv.Itoa(v))
 
 	case int32:
-		if withColor {
+		if opts.Color {
 			writer.WriteString(ansi.Red)
 		}
 		writer.WriteString(strconv.Itoa(int(v)))
 
 	case int64:
-		if withColor {
+		if opts.Color {
 			writer.WriteString(ansi.Red)
 		}
 		writer.WriteString(strconv.Itoa(int(v)))
 
 	case float32:
-		if withColor {
+		if opts.Color {
 			writer.WriteString(ansi.Red)
 		}
 		writer.WriteString(strconv.FormatFloat(float64(v), 'g', -1, 32))
 
 	case float64:
-		if withColor {
+		if opts.Color {
 			writer.WriteString(ansi.Red)
 		}
 		writer.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
 
 	case bool:
-		if withColor {
+		if opts.Color {
 			writer.WriteString(ansi.Red)
 		}
 		writer.WriteString(strconv.FormatBool(v))
@@ -947,18 +1210,30 @@ func (node *AclNode) maybeWriteNewline(writer *bufio.Writer, indentStr string, l
 // it has. When child nodes only have a single child it will collapse
 // those nodes. (maybe??)
 func (node *AclNode) StringTo(writer *bufio.Writer, indentStr string, level int, withColor bool) {
+	node.stringTo(writer, level, nil, &StringOpts{Indent: indentStr, Color: withColor})
+}
+
+// Like StringTo but with options, such as keys to redact
+func (node *AclNode) StringToWithOpts(writer *bufio.Writer, opts *StringOpts) {
+	if opts == nil {
+		opts = &StringOpts{}
+	}
+	node.stringTo(writer, 0, nil, opts)
+}
+
+func (node *AclNode) stringTo(writer *bufio.Writer, level int, path []string, opts *StringOpts) {
 
 	//alog.Info("StringTo len(Values)=%d, len(Children)=%d", len(node.Values), len(node.Children))
 	if len(node.Values) > 0 {
 		// Print the values ignoring the children
 		if len(node.Values) == 1 {
-			node.valueTo(writer, indentStr, level, withColor, node.Values[0])
+			node.valueTo(writer, level, path, opts, node.Values[0])
 		} else {
-			if withColor {
+			if opts.Color {
 				writer.WriteString(ansi.Cyan)
 			}
 			writer.WriteString("[")
-			if !node.maybeWriteNewline(writer, indentStr, level+1) {
+			if !node.maybeWriteNewline(writer, opts.Indent, level+1) {
 				writer.WriteString(" ")
 			}
 
@@ -966,8 +1241,8 @@ func (node *AclNode) StringTo(writer *bufio.Writer, indentStr string, level int,
 			for ix, value := range node.Values {
 				isLast := ix == lastIx
 
-				node.valueTo(writer, indentStr, level+1, withColor, value)
-				if withColor {
+				node.valueTo(writer, level+1, path, opts, value)
+				if opts.Color {
 					writer.WriteString(ansi.Cyan)
 				}
 				iLevel := level + 1
@@ -976,22 +1251,22 @@ func (node *AclNode) StringTo(writer *bufio.Writer, indentStr string, level int,
 				} else {
 					writer.WriteString(",")
 				}
-				if !node.maybeWriteNewline(writer, indentStr, iLevel) {
+				if !node.maybeWriteNewline(writer, opts.Indent, iLevel) {
 					writer.WriteString(" ")
 				}
 			}
-			if withColor {
+			if opts.Color {
 				writer.WriteString(ansi.Cyan)
 			}
 			writer.WriteString("]")
 		}
 	} else {
 		// It is a map node with children instead of values
-		if withColor {
+		if opts.Color {
 			writer.WriteString(ansi.Magenta)
 		}
 		writer.WriteString("{")
-		if !node.maybeWriteNewline(writer, indentStr, level+1) {
+		if !node.maybeWriteNewline(writer, opts.Indent, level+1) {
 			writer.WriteString(" ")
 		}
 
@@ -1011,30 +1286,43 @@ func (node *AclNode) StringTo(writer *bufio.Writer, indentStr string, level int,
 		for ix, name := range keys {
 			isLast := ix == last
 
-			if withColor {
+			if opts.Color {
 				writer.WriteString(ansi.Black)
 			}
 			obj := node.Children[name]
 
-			if withColor {
+			if opts.Color {
 				writer.WriteString(ansi.Blue)
 			}
-			writer.WriteString(strconv.Quote(name))
+			if cond, ok := parseConditionKey(name); ok {
+				// Written so it can be parsed again
+				writer.WriteString(cond.String() + " ")
+			} else {
+				writer.WriteString(strconv.Quote(name))
 
-			if withColor {
-				writer.WriteString(ansi.Magenta)
+				if opts.Color {
+					writer.WriteString(ansi.Magenta)
+				}
+				if obj.UsesEquals {
+					writer.WriteString(" = ")
+				} else {
+					writer.WriteString(": ")
+				}
 			}
-			if obj.UsesEquals {
-				writer.WriteString(" = ")
+			childPath := append(path[:len(path):len(path)], name)
+			if opts.redacts(childPath) {
+				if opts.Color {
+					writer.WriteString(ansi.Yellow)
+				}
+				writer.WriteString(strconv.Quote(MASKED_VALUE))
 			} else {
-				writer.WriteString(": ")
-			}
-			if withColor {
-				writer.WriteString(ansi.Black)
+				if opts.Color {
+					writer.WriteString(ansi.Black)
+				}
+				node.valueTo(writer, level+1, childPath, opts, obj)
 			}
-			node.valueTo(writer, indentStr, level+1, withColor, obj)
 
-			if withColor {
+			if opts.Color {
 				writer.WriteString(ansi.Cyan)
 			}
 
@@ -1042,23 +1330,23 @@ func (node *AclNode) StringTo(writer *bufio.Writer, indentStr string, level int,
 			if isLast {
 				iLevel--
 			} else {
-				if withColor {
+				if opts.Color {
 					writer.WriteString(ansi.Magenta)
 				}
 				writer.WriteString(",")
 			}
 
-			if !node.maybeWriteNewline(writer, indentStr, iLevel) {
+			if !node.maybeWriteNewline(writer, opts.Indent, iLevel) {
 				writer.WriteString(" ")
 			}
 		}
-		if withColor {
+		if opts.Color {
 			writer.WriteString(ansi.Magenta)
 		}
 		writer.WriteString("}")
 	}
 
-	if withColor {
+	if opts.Color {
 		writer.WriteString(ansi.Reset)
 	}
 	writer.Flush()
@@ -1114,6 +1402,62 @@ func (l *ParseLocation) Error() string {
 	return fmt.Sprintf("%v:%d:%d: %v", l.Filename, l.Line, l.Col, l.Message)
 }
 
+// All the errors found while parsing, in the order they were found. After
+// an error the parser picks up again at the next newline or closing brace,
+// so when it finds more than one it returns these rather than a single
+// *ParseLocation. Load also returns one of these with the errors from every
+// file and string in the cascade. errors.As will find the first
+// *ParseLocation in the list.
+type ParseErrors []*ParseLocation
+
+func (e ParseErrors) Error() string {
+	lines := make([]string, len(e))
+	for ix, l := range e {
+		lines[ix] = l.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e ParseErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for ix, l := range e {
+		errs[ix] = l
+	}
+	return errs
+}
+
+// Gives every parse error in err whether it's a single *ParseLocation or
+// ParseErrors, or nil if err isn't from parsing.
+func ParseErrorsOf(err error) ParseErrors {
+	switch e := err.(type) {
+	case *ParseLocation:
+		return ParseErrors{e}
+	case ParseErrors:
+		return e
+	}
+	return nil
+}
+
+// Adds the parse errors in err to the list, returning false if err isn't
+// from parsing
+func (e *ParseErrors) add(err error) bool {
+	found := ParseErrorsOf(err)
+	*e = append(*e, found...)
+	return found != nil
+}
+
+// The list as an error the same way the parser returns it, so nil if it's
+// empty and the *ParseLocation if there's only one
+func (e ParseErrors) err() error {
+	switch len(e) {
+	case 0:
+		return nil
+	case 1:
+		return e[0]
+	}
+	return e
+}
+
 // StringToACL is a function for immediately parsing simple configs into
 // an AclNode tree. It is useful for test case writing, but probably should not
 // be used for real code because it hides errors.
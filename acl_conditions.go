@@ -0,0 +1,252 @@
+package archercl
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Conditional blocks let one config work across different hosts:
+//
+//	if hostname =~ "^web-" {
+//		server workers: 16
+//	}
+//	when os == linux {
+//		logging backends syslog type: syslog
+//	}
+//
+// "if" and "when" mean the same thing. The left side is the name of a fact,
+// the operator is one of ==, !=, =~ (matches a regular expression) or !~,
+// and the right side is a quoted string or a single word. A block whose
+// condition is true is merged into the object around it the same way as a
+// later file in the cascade, so ! resets work in it, and the block is
+// removed whether it was true or not. Load evaluates them once the files
+// are loaded, before profiles are applied, and again at the end for any that
+// came from the environment or command line.
+//
+// The facts come from DefaultFacts plus Opts.Facts. Unknown facts are empty.
+
+// Conditional blocks are stored under keys starting with this until they are
+// evaluated
+const condMarker = "\x00cond:"
+
+type condition struct {
+	keyword string
+	fact    string
+	op      string
+	value   string
+}
+
+func (c *condition) key() string {
+	return condMarker + strings.Join([]string{c.keyword, c.fact, c.op, c.value}, "\x00")
+}
+
+// Writes the condition the way it's written in a config file
+func (c *condition) String() string {
+	return c.keyword + " " + c.fact + " " + c.op + " " + strconv.Quote(c.value)
+}
+
+func parseConditionKey(key string) (*condition, bool) {
+	if !strings.HasPrefix(key, condMarker) {
+		return nil, false
+	}
+	parts := strings.Split(key[len(condMarker):], "\x00")
+	if len(parts) != 4 {
+		return nil, false
+	}
+	return &condition{keyword: parts[0], fact: parts[1], op: parts[2], value: parts[3]}, true
+}
+
+func (c *condition) eval(facts map[string]string) (bool, error) {
+	fact := facts[c.fact]
+	switch c.op {
+	case "==":
+		return fact == c.value, nil
+	case "!=":
+		return fact != c.value, nil
+	}
+
+	re, err := regexp.Compile(c.value)
+	if err != nil {
+		return false, fmt.Errorf("Bad regular expression in '%s': %v", c.String(), err)
+	}
+	return re.MatchString(fact) == (c.op == "=~"), nil
+}
+
+var conditionOps = []string{"==", "!=", "=~", "!~"}
+
+// Parses "if fact op value" up to the { that starts the block, which has to
+// be at the start of a statement.
+func parseConditionHeader(data string, i int) (*condition, int, bool) {
+	j := i - 1
+	for j >= 0 && (data[j] == ' ' || data[j] == '\t' || data[j] == '\r') {
+		j--
+	}
+	if j >= 0 && !strings.ContainsRune("\n{,;", rune(data[j])) {
+		return nil, 0, false
+	}
+
+	c := &condition{}
+	switch {
+	case strings.HasPrefix(data[i:], "if"):
+		c.keyword = "if"
+	case strings.HasPrefix(data[i:], "when"):
+		c.keyword = "when"
+	default:
+		return nil, 0, false
+	}
+	i += len(c.keyword)
+
+	start := skipBlanks(data, i)
+	if start == i {
+		return nil, 0, false
+	}
+	i = start
+	for i < len(data) && (isIdentChar(data[i]) || data[i] == '.' || data[i] == '-') && data[i] != '!' {
+		i++
+	}
+	if i == start {
+		return nil, 0, false
+	}
+	c.fact = data[start:i]
+
+	i = skipBlanks(data, i)
+	for _, op := range conditionOps {
+		if strings.HasPrefix(data[i:], op) {
+			c.op = op
+			break
+		}
+	}
+	if c.op == "" {
+		return nil, 0, false
+	}
+	i = skipBlanks(data, i+len(c.op))
+
+	if i >= len(data) {
+		return nil, 0, false
+	}
+	if data[i] == '"' || data[i] == '\'' {
+		end := skipQuoted(data, i)
+		if end-i < 2 || data[end-1] != data[i] {
+			return nil, 0, false
+		}
+		v, err := strconv.Unquote(singlesToDoubles(data[i:end]))
+		if err != nil {
+			return nil, 0, false
+		}
+		c.value = v
+		i = end
+	} else {
+		start = i
+		for i < len(data) && !strings.ContainsRune(" \t\r\n{", rune(data[i])) {
+			i++
+		}
+		c.value = data[start:i]
+	}
+
+	i = skipBlanks(data, i)
+	if i >= len(data) || data[i] != '{' {
+		return nil, 0, false
+	}
+	return c, i, true
+}
+
+// The facts conditions can use: hostname, os, arch, user and env.NAME for
+// each environment variable.
+func DefaultFacts() map[string]string {
+	return hostFacts(os.Environ(), nil, true)
+}
+
+// The default facts with the env.NAME ones taken from environ and given
+// over the top of them. The hostname and user are only looked up if
+// lookupHost is set and they aren't given.
+func hostFacts(environ []string, given map[string]string, lookupHost bool) map[string]string {
+	facts := map[string]string{
+		"os":   runtime.GOOS,
+		"arch": runtime.GOARCH,
+	}
+
+	if _, ok := given["hostname"]; lookupHost && !ok {
+		if hostname, err := os.Hostname(); err == nil {
+			facts["hostname"] = hostname
+		}
+	}
+	if _, ok := given["user"]; lookupHost && !ok {
+		if current, err := user.Current(); err == nil {
+			facts["user"] = current.Username
+		}
+	}
+	for _, e := range environ {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 2 {
+			facts["env."+kv[0]] = kv[1]
+		}
+	}
+	for k, v := range given {
+		facts[k] = v
+	}
+
+	return facts
+}
+
+// Evaluates every conditional block in the tree against the facts, merging
+// the ones that are true into the object around them and removing them all.
+// A block with a bad condition is dropped and reported in the error.
+func (node *AclNode) ApplyConditions(facts map[string]string) error {
+	var problems []string
+	node.applyConditions(facts, &problems)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+func (node *AclNode) applyConditions(facts map[string]string, problems *[]string) {
+	if node == nil {
+		return
+	}
+
+	names := make([]string, 0, len(node.Children))
+	for name := range node.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		node.Children[name].applyConditions(facts, problems)
+	}
+
+	var kept []string
+	var blocks []*AclNode
+	for _, name := range node.OrderedChildNames {
+		cond, ok := parseConditionKey(name)
+		if !ok {
+			kept = append(kept, name)
+			continue
+		}
+
+		block := node.Children[name]
+		delete(node.Children, name)
+
+		match, err := cond.eval(facts)
+		if err != nil {
+			*problems = append(*problems, err.Error())
+		}
+		if match && block != nil {
+			blocks = append(blocks, block)
+		}
+	}
+	if len(blocks) == 0 && len(kept) == len(node.OrderedChildNames) {
+		return
+	}
+
+	node.OrderedChildNames = append(make([]string, 0, len(kept)), kept...)
+	for _, block := range blocks {
+		node.Merge(block)
+	}
+}
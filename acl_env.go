@@ -0,0 +1,139 @@
+package archercl
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/op/go-logging"
+)
+
+// How environment variables are turned into config values by
+// ParseEnvironWith. Load builds one of these from the Env fields in Opts.
+type EnvMapping struct {
+	// Only variables starting with this followed by an underscore are
+	// used, and the prefix and underscore are removed to get the key path.
+	// If it's empty only the Bindings are used, rather than letting
+	// unrelated variables into the config.
+	Prefix string
+
+	// What separates the keys in a path. The default is "_", which means a
+	// key can't have an underscore in it, so "__" is usually a better choice:
+	// APP_db__max_conns=5 sets "db max_conns".
+	Separator string
+
+	// If set each key is matched to an existing key in the config ignoring
+	// case, and otherwise lower cased, so APP_SERVER__MAXCONNS can set
+	// "server maxConns" from a file.
+	FoldCase bool
+
+	// Whole variable names, which don't need the prefix, mapped to the key
+	// path they set, such as {"DATABASE_URL": {"db", "url"}}
+	Bindings map[string][]string
+}
+
+// Values starting with one of these are parsed as ACL, otherwise they are
+// only parsed as ACL if they look like a number
+const envExpressionStart = "[{\"'"
+
+// Sets values from environment variables in the KEY=value form of
+// os.Environ(). Unlike ParseEnviron the values are parsed as ACL values, so
+// numbers become numbers and arrays and objects can be given:
+//
+//	APP_ports='[ 80, 443 ]'
+//	APP_db='{ host: localhost, !port: 5432 }'
+//
+// Anything else is used as a string, including values that don't parse. Each
+// variable replaces whatever was at its key path before.
+func (node *AclNode) ParseEnvironWith(env []string, mapping *EnvMapping) {
+	if mapping == nil {
+		mapping = &EnvMapping{}
+	}
+	sep := mapping.Separator
+	if sep == "" {
+		sep = "_"
+	}
+
+	for _, e := range env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		name, value := kv[0], kv[1]
+
+		path, bound := mapping.Bindings[name]
+		if !bound {
+			if mapping.Prefix == "" || !strings.HasPrefix(name, mapping.Prefix+"_") {
+				continue
+			}
+			path = strings.Split(name[len(mapping.Prefix)+1:], sep)
+		}
+
+		ok := len(path) > 0
+		for _, k := range path {
+			ok = ok && len(k) > 0
+		}
+		if !ok {
+			node.logDelayed(logging.WARNING, "Ignoring environment variable "+name+" which has an empty key")
+			continue
+		}
+
+		if !bound && mapping.FoldCase {
+			path = node.foldPath(path)
+		}
+
+		// Check it parses first so a bad value doesn't leave half of
+		// itself behind
+		str := envToACL(path, value)
+		err := NewAclNode().ParseString(str, &ParseLocation{Filename: "ENV(" + name + ")"})
+		if err != nil {
+			node.logDelayed(logging.WARNING, "Using environment variable "+name+" as a string: "+err.Error())
+			str = envToACL(path, strconv.Quote(value))
+		}
+		node.ParseString(str, nil)
+	}
+}
+
+// Finds the existing keys that match path ignoring case, lower casing the
+// ones that don't exist yet.
+func (node *AclNode) foldPath(path []string) []string {
+	out := make([]string, len(path))
+	current := node
+	for ix, k := range path {
+		out[ix] = strings.ToLower(k)
+
+		var next *AclNode
+		if current != nil {
+			for _, name := range current.OrderedChildNames {
+				if strings.EqualFold(name, k) {
+					out[ix] = name
+					next = current.Children[name]
+					break
+				}
+			}
+		}
+		current = next
+	}
+	return out
+}
+
+// Makes an ACL string that sets path to the value from the environment,
+// replacing anything that was there.
+func envToACL(path []string, value string) string {
+	trimmed := strings.TrimSpace(value)
+	isExpr := len(trimmed) > 0 && strings.ContainsRune(envExpressionStart, rune(trimmed[0]))
+	if !isExpr && !aclNumberRegexp.MatchString(trimmed) {
+		value = strconv.Quote(value)
+	}
+	return resetKeysACL(path) + ": " + value
+}
+
+// Looks up a variable in a list in the KEY=value form of os.Environ(). If a
+// name is there more than once the last one wins, like it does for exec.
+func lookupEnv(environ []string, name string) (string, bool) {
+	for ix := len(environ) - 1; ix >= 0; ix-- {
+		if strings.HasPrefix(environ[ix], name+"=") {
+			return environ[ix][len(name)+1:], true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,416 @@
+package archercl
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/op/go-logging"
+)
+
+// Command line arguments after "--", or a lone "-", that aren't bound to a
+// positional flag end up in a list of strings under this key.
+const ARGS_KEY = "args"
+
+// A command line flag which sets a value in the config. Flags are turned into
+// ACL strings and parsed at the same point in the cascade as any other ACL
+// strings from the command line, after the files and the environment.
+//
+//	archercl.Flag("port", "The port to listen on", "server", "port").Short = "p"
+//	archercl.BoolFlag("verbose", "Log everything", "logging", "level")
+//
+// Given the above "-p 8080", "--port=8080" and "--port 8080" all set
+// "server port" to 8080. Any key path can also be set without registering a
+// flag by using dots, as in "--server.port=8080".
+type CmdFlag struct {
+	// The long name, used as --name
+	Name string
+
+	// An optional single letter alias, used as -s
+	Short string
+
+	// Shown by --help
+	Usage string
+
+	// Where the value goes in the config
+	Path []string
+
+	// A boolean flag doesn't take a value. --name sets it to true and
+	// --no-name sets it to false, though --name=false works too.
+	Bool bool
+
+	// Positional flags are filled in order from the arguments that don't
+	// start with a dash
+	Positional bool
+}
+
+var (
+	flagsMutex sync.Mutex
+	cmdFlags   []*CmdFlag
+)
+
+// Called when --help or -h is on the command line. By default it writes the
+// usage to stdout and exits, but it can be replaced to do something else.
+var ShowHelp = func() {
+	WriteFlagUsage(os.Stdout, filepath.Base(os.Args[0]))
+	os.Exit(0)
+}
+
+// Registers a flag which takes a value and puts it at path in the config. If
+// path is empty the name is used as a top level key. Registering a name that
+// already exists replaces the earlier flag.
+func Flag(name, usage string, path ...string) *CmdFlag {
+	return addFlag(&CmdFlag{Name: name, Usage: usage, Path: path})
+}
+
+// Registers a flag that doesn't take a value. See CmdFlag.Bool.
+func BoolFlag(name, usage string, path ...string) *CmdFlag {
+	return addFlag(&CmdFlag{Name: name, Usage: usage, Path: path, Bool: true})
+}
+
+// Registers a positional argument. They are filled in the order they are
+// registered from arguments that don't start with a dash. Once all of them
+// have a value any further arguments are parsed as ACL strings like before.
+func Positional(name, usage string, path ...string) *CmdFlag {
+	return addFlag(&CmdFlag{Name: name, Usage: usage, Path: path, Positional: true})
+}
+
+// Removes a flag, mostly for tests.
+func RemoveFlag(name string) {
+	flagsMutex.Lock()
+	defer flagsMutex.Unlock()
+
+	for ix, f := range cmdFlags {
+		if f.Name == name {
+			cmdFlags = append(cmdFlags[:ix:ix], cmdFlags[ix+1:]...)
+			return
+		}
+	}
+}
+
+func addFlag(f *CmdFlag) *CmdFlag {
+	if len(f.Path) == 0 {
+		f.Path = []string{f.Name}
+	}
+
+	flagsMutex.Lock()
+	defer flagsMutex.Unlock()
+
+	for ix, existing := range cmdFlags {
+		if existing.Name == f.Name {
+			cmdFlags[ix] = f
+			return f
+		}
+	}
+	cmdFlags = append(cmdFlags, f)
+	return f
+}
+
+// A copy of the registered flags so they can be looked at without the lock
+func registeredFlags() []*CmdFlag {
+	flagsMutex.Lock()
+	defer flagsMutex.Unlock()
+
+	out := make([]*CmdFlag, len(cmdFlags))
+	for ix, f := range cmdFlags {
+		fc := *f
+		out[ix] = &fc
+	}
+	return out
+}
+
+// Writes the generated help text for the built in and registered flags.
+func WriteFlagUsage(w io.Writer, programName string) {
+	flags := registeredFlags()
+
+	var positional []*CmdFlag
+	for _, f := range flags {
+		if f.Positional {
+			positional = append(positional, f)
+		}
+	}
+
+	fmt.Fprintf(w, "Usage: %s [options]", programName)
+	for _, f := range positional {
+		fmt.Fprintf(w, " [%s]", f.Name)
+	}
+	fmt.Fprint(w, " [ACL strings...] [-- args...]\n")
+
+	if len(positional) > 0 {
+		fmt.Fprint(w, "\nArguments:\n")
+		for _, f := range positional {
+			writeUsageLine(w, f.Name, f.Usage, f.Path)
+		}
+	}
+
+	fmt.Fprint(w, "\nOptions:\n")
+	writeUsageLine(w, "-c, --config FILE", "Load a config file after the default ones", nil)
+	writeUsageLine(w, "-i, --ignore", "Don't load the default config files", nil)
+	writeUsageLine(w, "    --profile NAME", "Use a profile from the config", nil)
+	writeUsageLine(w, "-h, --help", "Show this help", nil)
+	for _, f := range flags {
+		if f.Positional {
+			continue
+		}
+
+		left := "    --"
+		if len(f.Short) > 0 {
+			left = "-" + f.Short + ", --"
+		}
+		left += f.Name
+		if f.Bool {
+			left = strings.Replace(left, "--", "--[no-]", 1)
+		} else {
+			left += " VALUE"
+		}
+		writeUsageLine(w, left, f.Usage, f.Path)
+	}
+	writeUsageLine(w, "    --key.path=VALUE", "Set any value in the config", nil)
+}
+
+func writeUsageLine(w io.Writer, left, usage string, path []string) {
+	if len(path) > 0 {
+		usage += " (" + strings.Join(path, " ") + ")"
+	}
+	if len(left) < 24 {
+		fmt.Fprintf(w, "  %-24s %s\n", left, usage)
+	} else {
+		fmt.Fprintf(w, "  %s\n  %-24s %s\n", left, "", usage)
+	}
+}
+
+// Values that look like numbers are left as they are so that they are parsed
+// as numbers, everything else becomes a quoted string.
+var aclNumberRegexp = regexp.MustCompile(`^([+-]?[0-9]+(\.[0-9]+)?|0x[0-9a-fA-F]+)$`)
+
+// Turns a key path and a value from the command line into an ACL string. The
+// last key is a reset key so the value replaces whatever the files had
+// rather than being added to it.
+func flagToACL(path []string, value string) string {
+	if !aclNumberRegexp.MatchString(value) {
+		value = strconv.Quote(value)
+	}
+	return resetKeysACL(path) + ": " + value
+}
+
+// The quoted keys for path with the last one being a reset key
+func resetKeysACL(path []string) string {
+	keys := make([]string, len(path))
+	for ix, k := range path {
+		if ix == len(path)-1 {
+			k = "!" + k
+		}
+		keys[ix] = strconv.Quote(k)
+	}
+	return strings.Join(keys, " ")
+}
+
+// What ParseCommandLine found in the arguments
+type CmdLine struct {
+	// Set by -i or --ignore
+	Ignore bool
+
+	// Files given with -c or --config
+	Filenames []string
+
+	// ACL strings, both ones given as arguments and ones made from flags
+	Strings []string
+
+	// Profiles given with --profile, see PROFILE_KEY
+	Profiles []string
+
+	// Set by -h or --help
+	Help bool
+}
+
+// Like ParseCmdLine but for any list of arguments, which don't include the
+// program name. -h or --help is accepted but, unlike ParseCommandLine, doesn't
+// call ShowHelp, so programs that don't know about it keep running.
+func ParseCmdLineArgs(args []string) (ignore bool, filenames []string, toParse []string) {
+	cl := parseCommandLine(args, logDelayed)
+	return cl.Ignore, cl.Filenames, cl.Strings
+}
+
+// Parses a list of arguments, which don't include the program name.
+//
+// Arguments can start with one or two dashes. Besides the registered flags
+// there are the built in -c/--config FILE, -i/--ignore, --profile NAME and
+// -h/--help. An argument that isn't a flag fills the next positional flag, or
+// if there aren't any left, is an ACL string. Everything after "--" is
+// positional, as is a lone "-", and the ones without a positional flag are
+// stored as a list under ARGS_KEY. Problems such as an unknown flag are
+// logged once logging is configured rather than stopping the program.
+// -h or --help calls ShowHelp.
+func ParseCommandLine(args []string) *CmdLine {
+	cl := parseCommandLine(args, logDelayed)
+	if cl.Help {
+		ShowHelp()
+	}
+	return cl
+}
+
+// Does the work for ParseCommandLine, sending problems to logMessage and
+// leaving help to the caller
+func parseCommandLine(args []string, logMessage func(logging.Level, string)) *CmdLine {
+	filenames := make([]string, 0)
+	toParse := make([]string, 0)
+	ignore := false
+	help := false
+	var profiles []string
+
+	flags := registeredFlags()
+	byName := make(map[string]*CmdFlag)
+	byShort := make(map[string]*CmdFlag)
+	var positional []*CmdFlag
+	for _, f := range flags {
+		if f.Positional {
+			positional = append(positional, f)
+			continue
+		}
+		byName[f.Name] = f
+		if len(f.Short) > 0 {
+			byShort[f.Short] = f
+		}
+	}
+
+	var extra []string
+	addPositional := func(arg string, isExtra bool) {
+		if len(positional) > 0 {
+			toParse = append(toParse, flagToACL(positional[0].Path, arg))
+			positional = positional[1:]
+		} else if isExtra {
+			extra = append(extra, arg)
+		} else {
+			// Store it as a string to parse after all files are loaded
+			toParse = append(toParse, arg)
+		}
+	}
+
+	for ix := 0; ix < len(args); ix++ {
+		arg := args[ix]
+		if len(arg) == 0 {
+			continue
+		}
+
+		if arg == "--" {
+			for _, rest := range args[ix+1:] {
+				addPositional(rest, true)
+			}
+			break
+		}
+
+		if arg == "-" || arg[0] != '-' {
+			addPositional(arg, arg == "-")
+			continue
+		}
+
+		name := strings.TrimPrefix(arg[1:], "-")
+		value := ""
+		hasValue := false
+		if eq := strings.IndexByte(name, '='); eq >= 0 {
+			name, value = name[:eq], name[eq+1:]
+			hasValue = true
+		}
+
+		// The value is either after the = or is the next argument
+		nextValue := func() (string, bool) {
+			if hasValue {
+				return value, true
+			}
+			if ix+1 < len(args) {
+				ix++
+				return args[ix], true
+			}
+			logMessage(logging.ERROR, "Missing a value for command line argument '"+arg+"'")
+			return "", false
+		}
+
+		switch name {
+		case "c", "config":
+			if v, ok := nextValue(); ok && len(v) > 0 {
+				filenames = append(filenames, v)
+			}
+			continue
+
+		case "i", "ignore":
+			ignore = true
+			continue
+
+		case "profile":
+			if v, ok := nextValue(); ok {
+				profiles = append(profiles, v)
+			}
+			continue
+
+		case "h", "help":
+			help = true
+			continue
+		}
+
+		f := byName[name]
+		if f == nil {
+			f = byShort[name]
+		}
+
+		negated := false
+		if f == nil && strings.HasPrefix(name, "no-") {
+			if nf := byName[name[3:]]; nf != nil && nf.Bool {
+				f = nf
+				negated = true
+			} else if strings.Contains(name, ".") && !hasValue {
+				// --no-key.path
+				f = &CmdFlag{Path: strings.Split(name[3:], "."), Bool: true}
+				negated = true
+			}
+		}
+
+		if f == nil && strings.Contains(name, ".") {
+			f = &CmdFlag{Path: strings.Split(name, ".")}
+		}
+
+		if f == nil {
+			logMessage(logging.ERROR, "Unrecognized command line argument '"+arg+"'")
+			continue
+		}
+
+		if f.Bool {
+			b := !negated
+			if hasValue {
+				var err error
+				b, err = strconv.ParseBool(value)
+				if err != nil || negated {
+					logMessage(logging.ERROR, "Bad value for boolean command line argument '"+arg+"'")
+					continue
+				}
+			}
+			// Left bare like true or false would be in a file
+			toParse = append(toParse, resetKeysACL(f.Path)+": "+strconv.FormatBool(b))
+			continue
+		}
+
+		if v, ok := nextValue(); ok {
+			toParse = append(toParse, flagToACL(f.Path, v))
+		}
+	}
+
+	if len(extra) > 0 {
+		quoted := make([]string, len(extra))
+		for ix, e := range extra {
+			quoted[ix] = strconv.Quote(e)
+		}
+		toParse = append(toParse, strconv.Quote("!"+ARGS_KEY)+": [ "+strings.Join(quoted, ", ")+" ]")
+	}
+
+	return &CmdLine{
+		Ignore:    ignore,
+		Filenames: filenames,
+		Strings:   toParse,
+		Profiles:  profiles,
+		Help:      help,
+	}
+}
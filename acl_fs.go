@@ -0,0 +1,82 @@
+package archercl
+
+import (
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/op/go-logging"
+)
+
+// Reads everything from r and parses it. The location is used for errors the
+// same as with ParseString.
+func (node *AclNode) ParseReader(r io.Reader, location *ParseLocation) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	return node.ParseString(string(data), location)
+}
+
+// Parses the files in fsys that match pattern in lexical order. The pattern
+// is the same as for fs.Glob, so a plain name is just that file. If nothing
+// matches the error is a *fs.PathError for fs.ErrNotExist. The parse errors
+// from all the files are returned together, but a file that can't be read
+// stops things.
+//
+// This works with an embed.FS for defaults bundled into the program or a
+// fstest.MapFS in tests.
+func (node *AclNode) ParseFS(fsys fs.FS, pattern string) error {
+	matches, err := fs.Glob(fsys, pattern)
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		return &fs.PathError{Op: "open", Path: pattern, Err: fs.ErrNotExist}
+	}
+
+	sort.Strings(matches)
+	var parseErrs ParseErrors
+	for _, name := range matches {
+		err = node.parseFSFile(fsys, name)
+		if err != nil && !parseErrs.add(err) {
+			return err
+		}
+	}
+	return parseErrs.err()
+}
+
+// Like ParseFile but for a file in fsys
+func (node *AclNode) parseFSFile(fsys fs.FS, name string) error {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		node.logDelayed(logging.NOTICE, "Could not open file "+name)
+		return err
+	}
+
+	location := &ParseLocation{
+		Filename: name,
+	}
+	err = node.ParseString(string(data), location)
+	if err != nil {
+		node.logDelayed(logging.ERROR, err.Error())
+	}
+
+	return err
+}
+
+// Turns a path from a search path template into a name in an fs.FS, which
+// are always relative and use slashes
+func fsName(p string) (string, bool) {
+	p = path.Clean(filepath.ToSlash(p))
+	p = strings.TrimLeft(p, "/")
+	if p == "" {
+		p = "."
+	}
+	return p, fs.ValidPath(p)
+}
@@ -216,6 +216,9 @@ func (root *AclNode) ParseStringWithLogger(data string, location *ParseLocation,
         location = new(ParseLocation)
     }
 
+    // secret(...) values and if/when blocks become something the FSM understands
+    data = preprocessACL(data)
+
     // These are the required variables for the ragel FSM code. data is also required
     // but is an input parameter
     cs, p, pe := 0, 0, len(data)
@@ -293,7 +296,8 @@ func (root *AclNode) ParseStringWithLogger(data string, location *ParseLocation,
             name := ctx.keyPath[ix]
 
             var next *AclNode
-            if name[0] == '!' {
+            reset := name[0] == '!'
+            if reset {
                 // Gotta nuke any existing things, so we do
                 // that by purposely not looking up the node
                 name = name[1:]
@@ -305,8 +309,11 @@ func (root *AclNode) ParseStringWithLogger(data string, location *ParseLocation,
             if next == nil {
                 // Oh hey, it's new (or a replacement in the reset case)
                 next = NewAclNode()
+                next.reset = reset
+                if target.Children[name] == nil {
+                    target.OrderedChildNames = append(target.OrderedChildNames, name)
+                }
                 target.Children[name] = next
-                target.OrderedChildNames = append(target.OrderedChildNames, name)
             }
 
             target = next
@@ -341,7 +348,7 @@ func (root *AclNode) ParseStringWithLogger(data string, location *ParseLocation,
             return errors.New("Can not parse "+q+" : "+err.Error())
         }
 
-        attachValue(v)
+        attachValue(quotedValue(v))
         return nil
     }
 
@@ -471,7 +478,7 @@ func (root *AclNode) ParseStringWithLogger(data string, location *ParseLocation,
 
     // Writing ragel comments with #// means they keep syntax highlighting working in sublime
     
-//line acl_parser.go:475
+//line acl_parser.go:482
 	{
 	cs = ACLParser_start
 	top = 0
@@ -480,7 +487,16 @@ func (root *AclNode) ParseStringWithLogger(data string, location *ParseLocation,
 	act = 0
 	}
 
-//line acl_parser.go:484
+//line acl_parser.rl:675
+
+
+    // The FSM stops at an error, so each one is recorded and then it's started
+    // again at the next newline or closing brace in whichever mode suits the
+    // current context. That way one pass finds every error in the data.
+    var errs ParseErrors
+    for {
+        
+//line acl_parser.go:500
 	{
 	var _klen int
 	var _trans int
@@ -503,7 +519,7 @@ _resume:
 //line NONE:1
 ts = p
 
-//line acl_parser.go:507
+//line acl_parser.go:523
 		}
 	}
 
@@ -573,7 +589,7 @@ _eof_trans:
 		_acts++
 		switch _ACLParser_actions[_acts-1] {
 		case 0:
-//line acl_parser.rl:332
+//line acl_parser.rl:339
  
             location.Line++ 
             // The entire stack becomes multiline
@@ -595,7 +611,7 @@ _eof_trans:
             }
         
 		case 1:
-//line acl_parser.rl:355
+//line acl_parser.rl:362
 top--; cs = stack[top]
 goto _again
 
@@ -604,7 +620,7 @@ goto _again
 te = p+1
 
 		case 5:
-//line acl_parser.rl:391
+//line acl_parser.rl:398
 te = p+1
 {
                 lprintf("Quoted literal %v\n", data[ts:te])
@@ -618,7 +634,7 @@ goto _again
                 }
             }
 		case 6:
-//line acl_parser.rl:436
+//line acl_parser.rl:443
 te = p+1
 {
                 if inArray() {
@@ -637,7 +653,7 @@ goto _again
 
             }
 		case 7:
-//line acl_parser.rl:451
+//line acl_parser.rl:458
 te = p+1
 {
                 lprintf("Value newline. inArray()=%v\n", inArray())
@@ -654,7 +670,7 @@ goto _again
                 // keys allowed in array contexts so nothing to reset.
             }
 		case 8:
-//line acl_parser.rl:466
+//line acl_parser.rl:473
 te = p+1
 {
                 startObject();
@@ -663,7 +679,7 @@ goto _again
 
             }
 		case 9:
-//line acl_parser.rl:474
+//line acl_parser.rl:481
 te = p+1
 {                
                 err := endObject()
@@ -687,13 +703,13 @@ goto _again
                 // keep adding values into the named target
             }
 		case 10:
-//line acl_parser.rl:493
+//line acl_parser.rl:500
 te = p+1
 {
                 startArray()
             }
 		case 11:
-//line acl_parser.rl:499
+//line acl_parser.rl:506
 te = p+1
 {
                 err := endArray()
@@ -714,7 +730,7 @@ goto _again
                 }                
             }
 		case 12:
-//line acl_parser.rl:516
+//line acl_parser.rl:523
 te = p+1
 { { 
             if top >= len(stack)-1 {
@@ -723,7 +739,7 @@ te = p+1
         stack[top] = cs; top++; cs = 5; goto _again
  } }
 		case 13:
-//line acl_parser.rl:525
+//line acl_parser.rl:532
 te = p+1
 {
                 if !inArray() {
@@ -738,13 +754,13 @@ goto _again
                 }
             }
 		case 14:
-//line acl_parser.rl:538
+//line acl_parser.rl:545
 te = p+1
 {
                 lprintf("Value Whitespace '%v'\n", data[ts:te])
             }
 		case 15:
-//line acl_parser.rl:543
+//line acl_parser.rl:550
 te = p+1
 {
                 location.Message = fmt.Sprintf("Syntax error. Invalid character '%v' while looking for a value.", data[ts:ts+1])
@@ -754,7 +770,7 @@ goto _again
 
             }
 		case 16:
-//line acl_parser.rl:386
+//line acl_parser.rl:393
 te = p
 p--
 { 
@@ -762,7 +778,7 @@ p--
                 stringValue(data[ts:te])
             }
 		case 17:
-//line acl_parser.rl:402
+//line acl_parser.rl:409
 te = p
 p--
 {
@@ -777,7 +793,7 @@ goto _again
                 }
             }
 		case 18:
-//line acl_parser.rl:413
+//line acl_parser.rl:420
 te = p
 p--
 {
@@ -792,7 +808,7 @@ goto _again
                 }
             }
 		case 19:
-//line acl_parser.rl:424
+//line acl_parser.rl:431
 te = p
 p--
 {
@@ -807,12 +823,12 @@ goto _again
                 }
             }
 		case 20:
-//line acl_parser.rl:521
+//line acl_parser.rl:528
 te = p
 p--
 
 		case 21:
-//line acl_parser.rl:543
+//line acl_parser.rl:550
 te = p
 p--
 {
@@ -823,7 +839,7 @@ goto _again
 
             }
 		case 22:
-//line acl_parser.rl:402
+//line acl_parser.rl:409
 p = (te) - 1
 {
                 lprintf("Value Integer %v\n", data[ts:te])
@@ -837,7 +853,7 @@ goto _again
                 }
             }
 		case 23:
-//line acl_parser.rl:543
+//line acl_parser.rl:550
 p = (te) - 1
 {
                 location.Message = fmt.Sprintf("Syntax error. Invalid character '%v' while looking for a value.", data[ts:ts+1])
@@ -847,7 +863,7 @@ goto _again
 
             }
 		case 24:
-//line acl_parser.rl:564
+//line acl_parser.rl:571
 te = p+1
 {
                 k := data[ts:te]
@@ -869,7 +885,7 @@ goto _again
                 }
             }
 		case 25:
-//line acl_parser.rl:581
+//line acl_parser.rl:588
 te = p+1
 {
                 ctxStack[len(ctxStack)-1].usesEqual = (data[ts] == '=')
@@ -883,13 +899,13 @@ te = p+1
  }
             }
 		case 26:
-//line acl_parser.rl:589
+//line acl_parser.rl:596
 te = p+1
 {
                 startObject()
             }
 		case 27:
-//line acl_parser.rl:596
+//line acl_parser.rl:603
 te = p+1
 {                
                 err := endObject()
@@ -914,7 +930,7 @@ goto _again
                 resetKey()
             }
 		case 28:
-//line acl_parser.rl:613
+//line acl_parser.rl:620
 te = p+1
 {
                 startArray()
@@ -926,7 +942,7 @@ te = p+1
  }
             }
 		case 29:
-//line acl_parser.rl:619
+//line acl_parser.rl:626
 te = p+1
 {
                 location.Message = "Array scope ended while in key mode indicates a parser state error."
@@ -936,7 +952,7 @@ goto _again
 
             }
 		case 30:
-//line acl_parser.rl:626
+//line acl_parser.rl:633
 te = p+1
 { { 
             if top >= len(stack)-1 {
@@ -945,19 +961,19 @@ te = p+1
         stack[top] = cs; top++; cs = 5; goto _again
  } }
 		case 31:
-//line acl_parser.rl:633
+//line acl_parser.rl:640
 te = p+1
 {
                 // fmt.Printf("Other '%v'\n", data[ts:te])
             }
 		case 32:
-//line acl_parser.rl:641
+//line acl_parser.rl:648
 te = p+1
 {
 
             }
 		case 33:
-//line acl_parser.rl:650
+//line acl_parser.rl:657
 te = p+1
 {
                 if len(ctxStack[len(ctxStack)-1].keyPath) > 0 {
@@ -969,7 +985,7 @@ goto _again
                 }
             }
 		case 34:
-//line acl_parser.rl:659
+//line acl_parser.rl:666
 te = p+1
 {
                 location.Message = fmt.Sprintf("Syntax error. Invalid character '%v' while looking for a key.", data[ts:ts+1])
@@ -979,7 +995,7 @@ goto _again
 
             }
 		case 35:
-//line acl_parser.rl:559
+//line acl_parser.rl:566
 te = p
 p--
 { 
@@ -987,12 +1003,12 @@ p--
                 appendKey(data[ts:te])
             }
 		case 36:
-//line acl_parser.rl:629
+//line acl_parser.rl:636
 te = p
 p--
 
 		case 37:
-//line acl_parser.rl:659
+//line acl_parser.rl:666
 te = p
 p--
 {
@@ -1003,7 +1019,7 @@ goto _again
 
             }
 		case 38:
-//line acl_parser.rl:659
+//line acl_parser.rl:666
 p = (te) - 1
 {
                 location.Message = fmt.Sprintf("Syntax error. Invalid character '%v' while looking for a key.", data[ts:ts+1])
@@ -1012,7 +1028,7 @@ p = (te) - 1
 goto _again
 
             }
-//line acl_parser.go:1016
+//line acl_parser.go:1032
 		}
 	}
 
@@ -1026,7 +1042,7 @@ _again:
 //line NONE:1
 ts = 0
 
-//line acl_parser.go:1030
+//line acl_parser.go:1046
 		}
 	}
 
@@ -1048,16 +1064,73 @@ ts = 0
 	_out: {}
 	}
 
-//line acl_parser.rl:669
+//line acl_parser.rl:682
+
 
+        if cs != ACLParser_error {
+            break
+        }
 
-    if cs == ACLParser_error {
         if len(location.Message) == 0 {
             location.Message = "Configuration file syntax error"
         }
-        fmt.Printf("Error! %v\n", location)
-        return location
+        found := *location
+        errs = append(errs, &found)
+        location.Message = ""
+
+        if p >= pe {
+            break
+        }
+
+        // The rest of an array with an error in it is skipped, otherwise the
+        // keys after it would end up as values in the array
+        resume := -1
+        if inArray() {
+            end := arrayEnd(data, p+1)
+            if end != -1 {
+                location.Line += strings.Count(data[p+1:end], "\n")
+                endArray()
+                resume = end + 1
+            } else {
+                for inArray() {
+                    popContext()
+                }
+            }
+        }
+        if resume == -1 {
+            next := strings.IndexAny(data[p+1:], "\n}")
+            if next == -1 {
+                break
+            }
+            resume = p + 1 + next
+        }
+        p = resume
+
+        ts, te, act = 0, 0, 0
+        if inArray() {
+            // Value mode is always called from key mode
+            if len(stack) == 0 {
+                stack = append(stack, 0)
+            }
+            stack[0] = ACLParser_en_main
+            top = 1
+            cs = ACLParser_en_value_mode
+        } else {
+            resetKey()
+            top = 0
+            cs = ACLParser_en_main
+        }
+    }
+
+    if len(errs) == 0 {
+        return nil
     }
 
-    return nil
+    // The location passed in ends up describing the first error, and it's
+    // what is returned when there's only one, the same as always
+    *location = *errs[0]
+    if len(errs) == 1 {
+        return location
+    }
+    return errs
 }
@@ -67,6 +67,9 @@ func (root *AclNode) ParseStringWithLogger(data string, location *ParseLocation,
         location = new(ParseLocation)
     }
 
+    // secret(...) values and if/when blocks become something the FSM understands
+    data = preprocessACL(data)
+
     // These are the required variables for the ragel FSM code. data is also required
     // but is an input parameter
     cs, p, pe := 0, 0, len(data)
@@ -144,7 +147,8 @@ func (root *AclNode) ParseStringWithLogger(data string, location *ParseLocation,
             name := ctx.keyPath[ix]
 
             var next *AclNode
-            if name[0] == '!' {
+            reset := name[0] == '!'
+            if reset {
                 // Gotta nuke any existing things, so we do
                 // that by purposely not looking up the node
                 name = name[1:]
@@ -156,8 +160,11 @@ func (root *AclNode) ParseStringWithLogger(data string, location *ParseLocation,
             if next == nil {
                 // Oh hey, it's new (or a replacement in the reset case)
                 next = NewAclNode()
+                next.reset = reset
+                if target.Children[name] == nil {
+                    target.OrderedChildNames = append(target.OrderedChildNames, name)
+                }
                 target.Children[name] = next
-                target.OrderedChildNames = append(target.OrderedChildNames, name)
             }
 
             target = next
@@ -192,7 +199,7 @@ func (root *AclNode) ParseStringWithLogger(data string, location *ParseLocation,
             return errors.New("Can not parse "+q+" : "+err.Error())
         }
 
-        attachValue(v)
+        attachValue(quotedValue(v))
         return nil
     }
 
@@ -665,16 +672,79 @@ func (root *AclNode) ParseStringWithLogger(data string, location *ParseLocation,
 
 
         write init;
-        write exec;
     }%%
 
-    if cs == ACLParser_error {
+    // The FSM stops at an error, so each one is recorded and then it's started
+    // again at the next newline or closing brace in whichever mode suits the
+    // current context. That way one pass finds every error in the data.
+    var errs ParseErrors
+    for {
+        %% write exec;
+
+        if cs != ACLParser_error {
+            break
+        }
+
         if len(location.Message) == 0 {
             location.Message = "Configuration file syntax error"
         }
-        fmt.Printf("Error! %v\n", location)
-        return location
+        found := *location
+        errs = append(errs, &found)
+        location.Message = ""
+
+        if p >= pe {
+            break
+        }
+
+        // The rest of an array with an error in it is skipped, otherwise the
+        // keys after it would end up as values in the array
+        resume := -1
+        if inArray() {
+            end := arrayEnd(data, p+1)
+            if end != -1 {
+                location.Line += strings.Count(data[p+1:end], "\n")
+                endArray()
+                resume = end + 1
+            } else {
+                for inArray() {
+                    popContext()
+                }
+            }
+        }
+        if resume == -1 {
+            next := strings.IndexAny(data[p+1:], "\n}")
+            if next == -1 {
+                break
+            }
+            resume = p + 1 + next
+        }
+        p = resume
+
+        ts, te, act = 0, 0, 0
+        if inArray() {
+            // Value mode is always called from key mode
+            if len(stack) == 0 {
+                stack = append(stack, 0)
+            }
+            stack[0] = ACLParser_en_main
+            top = 1
+            cs = ACLParser_en_value_mode
+        } else {
+            resetKey()
+            top = 0
+            cs = ACLParser_en_main
+        }
+    }
+
+    if len(errs) == 0 {
+        return nil
     }
 
-    return nil
+    // The location passed in ends up describing the first error, and it's
+    // what is returned when there's only one, the same as always
+    *location = *errs[0]
+    if len(errs) == 1 {
+        return location
+    }
+    return errs
 }
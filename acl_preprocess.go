@@ -0,0 +1,127 @@
+package archercl
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The parser is generated by ragel, so rather than growing the grammar for
+// secret("ref") values and if/when blocks they are rewritten before parsing
+// into quoted strings with markers that the rest of the package understands.
+// Everything is left alone inside quoted strings and comments, and anything
+// that isn't quite right is left for the parser to complain about.
+func preprocessACL(data string) string {
+	if !strings.Contains(data, "secret") && !strings.Contains(data, "if") && !strings.Contains(data, "when") {
+		return data
+	}
+
+	var sb strings.Builder
+	last := 0
+	replace := func(start, end int, with string) {
+		sb.WriteString(data[last:start])
+		sb.WriteString(with)
+		last = end
+	}
+
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == '"' || c == '\'':
+			i = skipQuoted(data, i)
+
+		case c == '#' || strings.HasPrefix(data[i:], "//") || strings.HasPrefix(data[i:], "--"):
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+
+		case strings.HasPrefix(data[i:], "/*"):
+			end := strings.Index(data[i+2:], "*/")
+			if end < 0 {
+				i = len(data)
+			} else {
+				i += end + 4
+			}
+
+		case i > 0 && isIdentChar(data[i-1]):
+			i++
+
+		case strings.HasPrefix(data[i:], "secret"):
+			ref, end, ok := parseSecretCall(data, i+len("secret"))
+			if !ok {
+				i += len("secret")
+				continue
+			}
+			replace(i, end, strconv.Quote(secretMarker+ref))
+			i = end
+
+		case strings.HasPrefix(data[i:], "if") || strings.HasPrefix(data[i:], "when"):
+			cond, end, ok := parseConditionHeader(data, i)
+			if !ok {
+				i++
+				continue
+			}
+			replace(i, end, strconv.Quote(cond.key()))
+			i = end
+
+		default:
+			i++
+		}
+	}
+
+	if last == 0 {
+		return data
+	}
+	sb.WriteString(data[last:])
+	return sb.String()
+}
+
+// Returns the index just past the quoted string starting at i
+func skipQuoted(data string, i int) int {
+	q := data[i]
+	i++
+	for i < len(data) {
+		switch data[i] {
+		case '\\':
+			i += 2
+			continue
+		case q:
+			return i + 1
+		}
+		i++
+	}
+	return len(data)
+}
+
+func skipBlanks(data string, i int) int {
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '!' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// Returns the index of the ] closing the array that data[i:] is in, skipping
+// nested arrays and quoted strings, or -1 if there isn't one. The parser uses
+// this to get past an array with an error in it.
+func arrayEnd(data string, i int) int {
+	depth := 0
+	for i < len(data) {
+		switch data[i] {
+		case '"', '\'':
+			i = skipQuoted(data, i)
+			continue
+		case '[':
+			depth++
+		case ']':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+		i++
+	}
+	return -1
+}
@@ -0,0 +1,122 @@
+package archercl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Profiles are overlays kept in the same file as the base config which are
+// only used when they are selected:
+//
+//	server port: 8080
+//	logging level: debug
+//
+//	profile production {
+//		server port: 80
+//		!logging { level: warning }
+//	}
+//
+// Selecting production, through Opts.Profiles, --profile production on the
+// command line or <PREFIX>_PROFILE=production in the environment, merges the
+// block over the rest of the config as if it came in a later file, so values
+// are added to and a key starting with ! replaces what was there. Once that's
+// done the profile blocks are removed, whether they were selected or not, so
+// the loaded config and a dump of it only have the result. A profile key
+// with a value rather than blocks is kept as it is.
+const PROFILE_KEY = "profile"
+
+// Merges other over node the same way as parsing other's text after node's
+// would. Values are added to existing ones, objects are merged, and a node
+// that was named with a reset key like "!key" replaces the existing one.
+// Nothing in other is shared with node afterwards.
+func (node *AclNode) Merge(other *AclNode) {
+	if node == nil || other == nil {
+		return
+	}
+
+	for _, v := range other.Duplicate().Values {
+		node.Values = append(node.Values, v)
+	}
+	if len(other.Values) > 0 {
+		node.UsesEquals = other.UsesEquals
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range other.OrderedChildNames {
+		src := other.Children[name]
+		if src == nil || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		dst := node.Children[name]
+		if dst == nil || src.reset {
+			if dst == nil {
+				node.OrderedChildNames = append(node.OrderedChildNames, name)
+			}
+			node.Children[name] = src.Duplicate()
+			continue
+		}
+		dst.Merge(src)
+	}
+}
+
+// Merges the named profiles over the config in order, so a later profile
+// wins over an earlier one, and then removes all of the profiles from it.
+// Profiles that don't exist are skipped and reported in the error.
+func (node *AclNode) ApplyProfiles(names ...string) error {
+	if node == nil {
+		return nil
+	}
+
+	// Only an object of profiles is removed, a plain value such as
+	// profile: "aws-dev" is something else and is left alone
+	profiles := node.Children[PROFILE_KEY]
+	if profiles != nil && len(profiles.Values) > 0 {
+		profiles = nil
+	}
+	if profiles != nil {
+		delete(node.Children, PROFILE_KEY)
+		kept := node.OrderedChildNames[:0]
+		for _, name := range node.OrderedChildNames {
+			if name != PROFILE_KEY {
+				kept = append(kept, name)
+			}
+		}
+		node.OrderedChildNames = kept
+	}
+
+	var missing []string
+	for _, name := range names {
+		profile := profiles.Child(name)
+		if profile == nil {
+			missing = append(missing, name)
+			continue
+		}
+		node.Merge(profile)
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("Unknown profile '%s'", strings.Join(missing, "', '"))
+	}
+	return nil
+}
+
+// Splits comma separated profile names, dropping empty ones and duplicates
+func splitProfiles(lists ...[]string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, list := range lists {
+		for _, item := range list {
+			for _, name := range strings.Split(item, ",") {
+				name = strings.TrimSpace(name)
+				if len(name) == 0 || seen[name] {
+					continue
+				}
+				seen[name] = true
+				out = append(out, name)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,132 @@
+package archercl
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+)
+
+// A list of key patterns at the root of the config which are redacted, on
+// top of Opts.RedactKeys, when the config is dumped. See StringOpts.RedactKeys.
+const REDACTKEYS_KEY = "redactKeys"
+
+// The keys that are redacted when Load dumps the config unless
+// Opts.RedactKeys is set. They cover the loggly token, TLS keys and the usual
+// names for passwords.
+var DefaultRedactKeys = []string{
+	"*password*",
+	"*passwd*",
+	"*secret*",
+	"*token*",
+	"*apikey*",
+	"*.key",
+	"key",
+}
+
+// Options for turning a node into text with StringToWithOpts
+type StringOpts struct {
+	// Written once for each level of nesting when a node is multiline,
+	// usually "\t"
+	Indent string
+
+	// Adds ASCII color codes to make it easier to read in a terminal
+	Color bool
+
+	// Glob patterns for the keys whose values are written as MASKED_VALUE
+	// instead of the real value. Patterns are matched without regard to
+	// case against the path of keys joined with dots, as in
+	// "logging.backends.loggly.token", so "*.token" matches a token
+	// anywhere but at the top. A pattern without a dot also matches the
+	// last key alone, so "key" matches "tls.key". If the key is an object
+	// the whole object is masked.
+	RedactKeys []string
+}
+
+func (opts *StringOpts) redacts(path []string) bool {
+	if len(opts.RedactKeys) == 0 {
+		return false
+	}
+
+	full := strings.ToLower(strings.Join(path, "."))
+	last := strings.ToLower(path[len(path)-1])
+	for _, pattern := range opts.RedactKeys {
+		pattern = strings.ToLower(pattern)
+		if globMatch(pattern, full) {
+			return true
+		}
+		if !strings.Contains(pattern, ".") && globMatch(pattern, last) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the node as a string with the values of any keys matching the
+// patterns masked. See StringOpts.RedactKeys.
+func (node *AclNode) RedactedString(redactKeys []string) string {
+	var buf bytes.Buffer
+
+	node.StringToWithOpts(bufio.NewWriter(&buf), &StringOpts{Indent: "\t", RedactKeys: redactKeys})
+
+	return buf.String()
+}
+
+// Finds the fields of a struct that are tagged as sensitive and returns
+// redaction patterns for them, so a struct that describes the config can mark
+// what shouldn't be logged:
+//
+//	type Config struct {
+//		DB struct {
+//			Host     string `acl:"host"`
+//			Password string `acl:"password,sensitive"`
+//		} `acl:"db"`
+//	}
+//
+// gives "db.password". The key is the name in the acl tag, or the field name
+// if there isn't one. Nested structs, and pointers to them, are followed.
+func SensitiveKeys(v interface{}) []string {
+	t := reflect.TypeOf(v)
+	var out []string
+	sensitiveKeys(t, nil, &out)
+	return out
+}
+
+func sensitiveKeys(t reflect.Type, path []string, out *[]string) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return
+	}
+
+	for ix := 0; ix < t.NumField(); ix++ {
+		field := t.Field(ix)
+		if field.PkgPath != "" {
+			// Unexported
+			continue
+		}
+
+		name := field.Name
+		sensitive := false
+		if tag, ok := field.Tag.Lookup("acl"); ok {
+			parts := strings.Split(tag, ",")
+			if parts[0] == "-" {
+				continue
+			}
+			if len(parts[0]) > 0 {
+				name = parts[0]
+			}
+			for _, opt := range parts[1:] {
+				sensitive = sensitive || opt == "sensitive"
+			}
+		}
+
+		fieldPath := append(path[:len(path):len(path)], name)
+		if sensitive {
+			*out = append(*out, strings.Join(fieldPath, "."))
+			continue
+		}
+		sensitiveKeys(field.Type, fieldPath, out)
+	}
+}
@@ -0,0 +1,201 @@
+package archercl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// What is shown instead of a sensitive value when a config is turned into a
+// string, such as when it's dumped to the log.
+const MASKED_VALUE = "<redacted>"
+
+// Secrets keep passwords and the like out of config files. Instead of the
+// value a file has a reference to where the value can be found:
+//
+//	db {
+//		password = secret("file:/run/secrets/db")
+//		token = secret("env:DB_TOKEN")
+//	}
+//
+// The part before the first colon picks a SecretResolver, and the rest is
+// given to it. Load resolves all the secrets after the cascade is done and
+// fails if any of them can't be. The resolved values read like any other
+// string through AsString and friends, and AsBool, AsInt and AsFloat parse
+// them, but they are masked in String(), ColoredString() and the dumped
+// config.
+
+// A secret reference that hasn't been resolved yet
+type SecretRef struct {
+	Ref string
+}
+
+// Writes the reference the way it's written in a config file
+func (s *SecretRef) String() string {
+	return "secret(" + strconv.Quote(s.Ref) + ")"
+}
+
+// A resolved secret. It's a string, but formatting it with %v or %s gives
+// MASKED_VALUE so it doesn't end up in a log by accident. AsString gives
+// the real value.
+type Secret string
+
+func (s Secret) String() string {
+	return MASKED_VALUE
+}
+
+// Looks up the value for the part of a secret reference after the scheme
+type SecretResolver func(ref string) (string, error)
+
+// The resolvers that are always available. Opts.SecretResolvers can add more
+// or replace these.
+var DefaultSecretResolvers = map[string]SecretResolver{
+	// The contents of a file without a trailing newline, which is how
+	// docker and kubernetes provide secrets
+	"file": func(ref string) (string, error) {
+		data, err := ioutil.ReadFile(ref)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	},
+
+	// An environment variable, which has to be set, though it can be empty
+	"env": envSecretResolver(nil),
+}
+
+// Resolves env: secrets from environ, or from the real environment if it's
+// nil
+func envSecretResolver(environ []string) SecretResolver {
+	return func(ref string) (string, error) {
+		var v string
+		var ok bool
+		if environ == nil {
+			v, ok = os.LookupEnv(ref)
+		} else {
+			v, ok = lookupEnv(environ, ref)
+		}
+		if !ok {
+			return "", fmt.Errorf("Environment variable %s is not set", ref)
+		}
+		return v, nil
+	}
+}
+
+// Replaces every SecretRef in the tree with the Secret it resolves to using
+// the resolvers, falling back to DefaultSecretResolvers. All the references
+// are tried, and the error lists the ones that couldn't be resolved.
+func (node *AclNode) ResolveSecrets(resolvers map[string]SecretResolver) error {
+	var problems []string
+	node.resolveSecrets(nil, resolvers, &problems)
+
+	if len(problems) == 0 {
+		return nil
+	}
+	if len(problems) == 1 {
+		return fmt.Errorf("Could not resolve the secret at %s", problems[0])
+	}
+	return fmt.Errorf("Could not resolve the secrets at:\n    %s", strings.Join(problems, "\n    "))
+}
+
+func (node *AclNode) resolveSecrets(path []string, resolvers map[string]SecretResolver, problems *[]string) {
+	if node == nil {
+		return
+	}
+
+	for ix, v := range node.Values {
+		ref, ok := v.(*SecretRef)
+		if !ok {
+			continue
+		}
+
+		value, err := resolveSecret(ref.Ref, resolvers)
+		if err != nil {
+			*problems = append(*problems, strings.Join(path, " ")+": "+err.Error())
+			continue
+		}
+		node.Values[ix] = Secret(value)
+	}
+
+	names := make([]string, 0, len(node.Children))
+	for name := range node.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		node.Children[name].resolveSecrets(append(path[:len(path):len(path)], name), resolvers, problems)
+	}
+}
+
+func resolveSecret(ref string, resolvers map[string]SecretResolver) (string, error) {
+	parts := strings.SplitN(ref, ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Secret '%s' has no scheme, such as file: or env:", ref)
+	}
+
+	resolver := resolvers[parts[0]]
+	if resolver == nil {
+		resolver = DefaultSecretResolvers[parts[0]]
+	}
+	if resolver == nil {
+		return "", fmt.Errorf("Unknown secret scheme '%s'", parts[0])
+	}
+
+	value, err := resolver(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", ref, err)
+	}
+	return value, nil
+}
+
+// The parser doesn't know about secret(...) so before parsing it's turned
+// into a quoted string starting with this, which can't be typed by accident,
+// and quoted strings starting with it become a SecretRef.
+const secretMarker = "\x00secret:"
+
+// Called by the parser for every quoted string value
+func quotedValue(v string) interface{} {
+	if strings.HasPrefix(v, secretMarker) {
+		return &SecretRef{Ref: v[len(secretMarker):]}
+	}
+	return v
+}
+
+// Parses the ("ref") after the word secret, returning the ref and where the
+// call ends
+func parseSecretCall(data string, i int) (string, int, bool) {
+	skipSpace := func() {
+		for i < len(data) && (data[i] == ' ' || data[i] == '\t') {
+			i++
+		}
+	}
+
+	skipSpace()
+	if i >= len(data) || data[i] != '(' {
+		return "", 0, false
+	}
+	i++
+	skipSpace()
+	if i >= len(data) || (data[i] != '"' && data[i] != '\'') {
+		return "", 0, false
+	}
+
+	end := skipQuoted(data, i)
+	if end > len(data) || data[end-1] != data[i] || end-i < 2 {
+		return "", 0, false
+	}
+	ref, err := strconv.Unquote(singlesToDoubles(data[i:end]))
+	if err != nil {
+		return "", 0, false
+	}
+
+	i = end
+	skipSpace()
+	if i >= len(data) || data[i] != ')' {
+		return "", 0, false
+	}
+	return ref, i + 1, true
+}
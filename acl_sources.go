@@ -0,0 +1,255 @@
+package archercl
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The places Load looks for config files when Opts.SearchPaths isn't set,
+// least important first so that later files override earlier ones. These are
+// templates, see Opts.SearchPaths for the variables.
+var DefaultSearchPaths = []string{
+	"/etc/{name}.acl",
+	"/etc/{name}.d/*.acl",
+	"{xdg_config_dirs}/{name}/config.acl",
+	"{home}/.{name}.acl",
+	"{xdg_config_home}/{name}/config.acl",
+	"./{name}.acl",
+}
+
+// What happened to a possible config file during Load
+type SourceStatus int
+
+const (
+	// The file was found and parsed
+	SOURCE_LOADED SourceStatus = iota
+
+	// There was no file, or no files matched a pattern
+	SOURCE_SKIPPED
+
+	// The file couldn't be read or parsed, or the search path was bad
+	SOURCE_FAILED
+)
+
+func (s SourceStatus) String() string {
+	switch s {
+	case SOURCE_LOADED:
+		return "loaded"
+	case SOURCE_SKIPPED:
+		return "skipped"
+	case SOURCE_FAILED:
+		return "failed"
+	}
+	return fmt.Sprintf("SourceStatus(%d)", int(s))
+}
+
+// A file that Load looked at, in the order they were looked at
+type Source struct {
+	// The file name, or the search path template or pattern if it couldn't
+	// be expanded or didn't match anything
+	Path string
+
+	Status SourceStatus
+
+	// Why the file was skipped or failed
+	Err error
+}
+
+func (s Source) String() string {
+	if s.Err != nil {
+		return s.Path + " " + s.Status.String() + ": " + s.Err.Error()
+	}
+	return s.Path + " " + s.Status.String()
+}
+
+// Reports the files that Load looked for while building this config, which
+// is only set on the root node returned by Load.
+func (node *AclNode) ListSources() []Source {
+	if node == nil {
+		return nil
+	}
+	return append([]Source(nil), node.sources...)
+}
+
+// The values for the variables in search path templates. There can be more
+// than one, as there is for {xdg_config_dirs}, in which case the template
+// expands to one path for each, least important first.
+func searchPathVars(programName string, environ []string) (map[string][]string, error) {
+	getenv := func(name string) string {
+		v, _ := lookupEnv(environ, name)
+		return v
+	}
+
+	vars := map[string][]string{
+		"name": {programName},
+	}
+
+	// Getting the home directory might not work in odd environments, which
+	// only matters if a template uses it
+	var homeErr error
+	home := getenv("HOME")
+	if home == "" {
+		if current, err := user.Current(); err == nil {
+			home = current.HomeDir
+		} else {
+			homeErr = err
+		}
+	}
+	if home != "" {
+		vars["home"] = []string{home}
+	}
+
+	configHome := getenv("XDG_CONFIG_HOME")
+	if configHome == "" && home != "" {
+		configHome = filepath.Join(home, ".config")
+	}
+	if configHome != "" {
+		vars["xdg_config_home"] = []string{configHome}
+	}
+
+	// XDG_CONFIG_DIRS is most important first
+	configDirs := getenv("XDG_CONFIG_DIRS")
+	if configDirs == "" {
+		configDirs = "/etc/xdg"
+	}
+	var dirs []string
+	for _, dir := range filepath.SplitList(configDirs) {
+		if len(dir) > 0 {
+			dirs = append([]string{dir}, dirs...)
+		}
+	}
+	vars["xdg_config_dirs"] = dirs
+
+	return vars, homeErr
+}
+
+// Replaces the {variables} in a search path template
+func expandSearchPath(template string, vars map[string][]string) ([]string, error) {
+	start := strings.IndexByte(template, '{')
+	if start < 0 {
+		return []string{template}, nil
+	}
+	end := strings.IndexByte(template[start:], '}')
+	if end < 0 {
+		return nil, fmt.Errorf("Unclosed variable in search path")
+	}
+	end += start
+
+	name := template[start+1 : end]
+	values, ok := vars[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown or unavailable variable {%s} in search path", name)
+	}
+
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		rest, err := expandSearchPath(template[end+1:], vars)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rest {
+			out = append(out, template[:start]+v+r)
+		}
+	}
+	return out, nil
+}
+
+// Loads all the files for the search path templates into cfg, recording
+// each one as a source. Only parse errors are returned, because a file that
+// exists but is broken is something the caller needs to know about. They
+// are collected from every file so they can all be fixed at once.
+func loadSearchPaths(cfg *AclNode, templates []string, programName string, fsys fs.FS, environ []string) error {
+	var parseErrs ParseErrors
+	var vars map[string][]string
+	var homeErr error
+	if fsys == nil {
+		vars, homeErr = searchPathVars(programName, environ)
+	} else {
+		// Nothing about the host is used when loading from an fs.FS, so
+		// templates using {home} and the like are skipped
+		vars = map[string][]string{"name": {programName}}
+	}
+
+	for _, template := range templates {
+		paths, err := expandSearchPath(template, vars)
+		if err != nil {
+			status := SOURCE_FAILED
+			if fsys != nil {
+				status = SOURCE_SKIPPED
+			} else if homeErr != nil && strings.Contains(template, "{home}") {
+				err = homeErr
+			}
+			cfg.sources = append(cfg.sources, Source{Path: template, Status: status, Err: err})
+			continue
+		}
+
+		for _, path := range paths {
+			if fsys != nil {
+				name, ok := fsName(path)
+				if !ok {
+					cfg.sources = append(cfg.sources, Source{Path: path, Status: SOURCE_FAILED, Err: fmt.Errorf("Not a valid name in the file system")})
+					continue
+				}
+				path = name
+			}
+
+			if !strings.ContainsAny(path, "*?[") {
+				parseErrs.add(loadSource(cfg, fsys, path))
+				continue
+			}
+
+			// Drop in directories are loaded in lexical order
+			var matches []string
+			if fsys == nil {
+				matches, err = filepath.Glob(path)
+			} else {
+				matches, err = fs.Glob(fsys, path)
+			}
+			if err != nil {
+				cfg.sources = append(cfg.sources, Source{Path: path, Status: SOURCE_FAILED, Err: err})
+				continue
+			}
+			if len(matches) == 0 {
+				cfg.sources = append(cfg.sources, Source{Path: path, Status: SOURCE_SKIPPED, Err: fmt.Errorf("No matching files")})
+				continue
+			}
+			sort.Strings(matches)
+			for _, match := range matches {
+				parseErrs.add(loadSource(cfg, fsys, match))
+			}
+		}
+	}
+
+	return parseErrs.err()
+}
+
+// Parses one file into cfg, from fsys if it isn't nil, and records what
+// happened. Returns the parse errors if it existed but couldn't be parsed.
+func loadSource(cfg *AclNode, fsys fs.FS, path string) error {
+	var err error
+	if fsys == nil {
+		err = cfg.ParseFile(path)
+	} else {
+		err = cfg.parseFSFile(fsys, path)
+	}
+
+	switch {
+	case err == nil:
+		cfg.sources = append(cfg.sources, Source{Path: path, Status: SOURCE_LOADED})
+
+	case errors.Is(err, fs.ErrNotExist):
+		cfg.sources = append(cfg.sources, Source{Path: path, Status: SOURCE_SKIPPED, Err: err})
+
+	default:
+		cfg.sources = append(cfg.sources, Source{Path: path, Status: SOURCE_FAILED, Err: err})
+		if ParseErrorsOf(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
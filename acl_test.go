@@ -1,7 +1,18 @@
 package archercl
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"testing/fstest"
+
+	"github.com/op/go-logging"
 )
 
 func init() {
@@ -185,3 +196,793 @@ func Test_StringOne(t *testing.T) {
 		t.Fatal("Expected: \n" + should + "But got\n" + str)
 	}
 }
+
+func Test_CmdLineFlags(t *testing.T) {
+	Flag("port", "The port to listen on", "server", "port").Short = "p"
+	BoolFlag("verbose", "Log everything", "logging", "verbose")
+	Positional("input", "The file to read", "input")
+	defer func() {
+		RemoveFlag("port")
+		RemoveFlag("verbose")
+		RemoveFlag("input")
+	}()
+
+	helped := false
+	oldHelp := ShowHelp
+	ShowHelp = func() { helped = true }
+	defer func() { ShowHelp = oldHelp }()
+
+	ignore, files, strs := ParseCmdLineArgs([]string{
+		"-p", "8080", "--no-verbose", "--config=extra.acl", "in.txt",
+		"name: bob", "--db.host=local host", "-", "-h", "--", "-x", "rest",
+	})
+	if ignore || len(files) != 1 || files[0] != "extra.acl" || helped {
+		t.Fatalf("Wrong ignore, files or help: %v %v %v", ignore, files, helped)
+	}
+	if !ParseCommandLine([]string{"-h"}).Help || !helped {
+		t.Fatal("ParseCommandLine should show the help")
+	}
+
+	// Booleans aren't quoted, like they wouldn't be in a file
+	if _, _, strs := ParseCmdLineArgs([]string{"--verbose"}); len(strs) != 1 || strs[0] != `"logging" "!verbose": true` {
+		t.Fatalf("Wrong ACL for a bool flag %q", strs)
+	}
+
+	cfg := NewAclNode()
+	cfg.ParseString("server port: 80", nil)
+	for _, str := range strs {
+		if err := cfg.ParseString(str, nil); err != nil {
+			t.Fatalf("Couldn't parse %q: %v", str, err)
+		}
+	}
+
+	if cfg.ChildAsInt("server", "port") != 8080 || len(cfg.Child("server", "port").Values) != 1 {
+		t.Fatalf("Wrong port in %s", cfg.String())
+	}
+	if cfg.Child("logging", "verbose") == nil || cfg.ChildAsBool("logging", "verbose") {
+		t.Fatalf("verbose should be false in %s", cfg.String())
+	}
+	if cfg.ChildAsString("input") != "in.txt" || cfg.ChildAsString("name") != "bob" {
+		t.Fatalf("Wrong positional or ACL string in %s", cfg.String())
+	}
+	if cfg.ChildAsString("db", "host") != "local host" {
+		t.Fatalf("Wrong dotted key in %s", cfg.String())
+	}
+
+	args := cfg.Child(ARGS_KEY)
+	if args == nil || len(args.Values) != 3 || args.AsStringN(0) != "-" || args.AsStringN(1) != "-x" {
+		t.Fatalf("Wrong extra args in %s", cfg.String())
+	}
+
+	// A lone dash used to panic
+	ParseCmdLineArgs([]string{"-"})
+
+	var usage bytes.Buffer
+	WriteFlagUsage(&usage, "prog")
+	for _, want := range []string{"[input]", "-p, --port VALUE", "--[no-]verbose", "(server port)"} {
+		if !strings.Contains(usage.String(), want) {
+			t.Fatalf("Usage is missing %q:\n%s", want, usage.String())
+		}
+	}
+}
+
+func Test_SearchPaths(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, text string) {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("app.acl", "a: 1, b: 1, c: 1")
+	write("app.d/20-second.acl", "b: 3")
+	write("app.d/10-first.acl", "b: 2, c: 2")
+	write("xdg/app/config.acl", "c: 4")
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "xdg"))
+
+	cfg, err := Load(&Opts{
+		Name:              "app",
+		IgnoreCommandLine: true,
+		IgnoreEnvironment: true,
+		SearchPaths: []string{
+			dir + "/{name}.acl",
+			dir + "/{name}.d/*.acl",
+			dir + "/missing/*.acl",
+			"{xdg_config_home}/{name}/config.acl",
+			dir + "/{name}.nothere",
+			"{bogus}/app.acl",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.ChildAsInt("a") != 1 || cfg.ChildAsInt("b") != 3 || cfg.ChildAsInt("c") != 4 {
+		t.Fatalf("Files weren't cascaded in order: %s", cfg.String())
+	}
+
+	want := []SourceStatus{SOURCE_LOADED, SOURCE_LOADED, SOURCE_LOADED, SOURCE_SKIPPED, SOURCE_LOADED, SOURCE_SKIPPED, SOURCE_FAILED}
+	sources := cfg.ListSources()
+	if len(sources) != len(want) {
+		t.Fatalf("Expected %d sources, got %v", len(want), sources)
+	}
+	for ix, s := range sources {
+		if s.Status != want[ix] {
+			t.Fatalf("Source %d should be %v: %v", ix, want[ix], sources)
+		}
+	}
+	if filepath.Base(sources[1].Path) != "10-first.acl" {
+		t.Fatalf("Drop ins should be sorted: %v", sources)
+	}
+
+	write("broken/app.acl", "a: }")
+	_, err = Load(&Opts{
+		Name:              "app",
+		IgnoreCommandLine: true,
+		IgnoreEnvironment: true,
+		SearchPaths:       []string{dir + "/broken/{name}.acl"},
+	})
+	if _, ok := err.(*ParseLocation); !ok {
+		t.Fatalf("Expected a parse error, got %v", err)
+	}
+}
+
+func Test_EnvMapping(t *testing.T) {
+	cfg := NewAclNode()
+	cfg.ParseString("server { maxConns: 1, ports: [ 1, 2 ] }, db url: old", nil)
+
+	cfg.ParseEnvironWith([]string{
+		"APP_SERVER__MAXCONNS=5",
+		"APP_server__ports=[ 80, 443 ]",
+		"APP_max_idle=2.5",
+		"APP_log__name={ \"bad",
+		"APP_cache={ size: 10, !ttl: 60 }",
+		"APP_greeting=hello world",
+		"APP_trailing__=x",
+		"DATABASE_URL=postgres://localhost/db",
+		"OTHER_thing=1",
+	}, &EnvMapping{
+		Prefix:    "APP",
+		Separator: "__",
+		FoldCase:  true,
+		Bindings:  map[string][]string{"DATABASE_URL": {"db", "url"}},
+	})
+
+	if cfg.ChildAsInt("server", "maxConns") != 5 || len(cfg.Child("server", "maxConns").Values) != 1 {
+		t.Fatalf("maxConns wasn't replaced with a number: %s", cfg.String())
+	}
+	ports := cfg.Child("server", "ports")
+	if len(ports.Values) != 2 || ports.AsIntN(0) != 80 || ports.AsIntN(1) != 443 {
+		t.Fatalf("Wrong ports: %s", cfg.String())
+	}
+	if cfg.ChildAsFloat("max_idle") != 2.5 {
+		t.Fatalf("Underscores should be kept in keys: %s", cfg.String())
+	}
+	if cfg.ChildAsString("log", "name") != "{ \"bad" {
+		t.Fatalf("A bad value should be a string: %s", cfg.String())
+	}
+	if cfg.ChildAsInt("cache", "size") != 10 || cfg.ChildAsInt("cache", "ttl") != 60 {
+		t.Fatalf("Wrong object value: %s", cfg.String())
+	}
+	if cfg.ChildAsString("greeting") != "hello world" {
+		t.Fatalf("Wrong string value: %s", cfg.String())
+	}
+	if cfg.ChildAsString("db", "url") != "postgres://localhost/db" || len(cfg.Child("db", "url").Values) != 1 {
+		t.Fatalf("Binding wasn't used: %s", cfg.String())
+	}
+	if cfg.Child("trailing") != nil || cfg.Child("thing") != nil {
+		t.Fatalf("Unexpected keys: %s", cfg.String())
+	}
+
+	// Without a prefix only the bindings are used
+	cfg = NewAclNode()
+	cfg.ParseEnvironWith([]string{
+		"PATH=/usr/bin",
+		"_private=1",
+		"_=/usr/bin/env",
+		"DATABASE_URL=postgres://localhost/db",
+	}, &EnvMapping{Bindings: map[string][]string{"DATABASE_URL": {"db", "url"}}})
+	if len(cfg.Children) != 1 || cfg.ChildAsString("db", "url") != "postgres://localhost/db" {
+		t.Fatalf("Expected only the binding without a prefix: %s", cfg.String())
+	}
+}
+
+func Test_Secrets(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "db")
+	os.WriteFile(secretFile, []byte("hunter2\n"), 0600)
+	t.Setenv("TEST_DB_TOKEN", "tok")
+
+	cfg := NewAclNode()
+	err := cfg.ParseString(`
+		# secret("not:this") is a comment
+		db {
+			password = secret("file:`+secretFile+`")
+			token: secret ( 'env:TEST_DB_TOKEN' ), note: "secret(\"nope\")"
+			vault = secret("vault:db/creds")
+		}
+	`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ref, ok := cfg.Child("db", "password").Values[0].(*SecretRef); !ok || ref.Ref != "file:"+secretFile {
+		t.Fatalf("Expected a secret reference: %s", cfg.String())
+	}
+	if cfg.ChildAsString("db", "note") != `secret("nope")` {
+		t.Fatalf("A quoted string shouldn't be a secret: %s", cfg.String())
+	}
+
+	// References survive a round trip through a string
+	again := NewAclNode()
+	if err := again.ParseString(cfg.String(), nil); err != nil || again.String() != cfg.String() {
+		t.Fatalf("References didn't round trip: %v\n%s\n%s", err, cfg.String(), again.String())
+	}
+
+	err = cfg.Duplicate().ResolveSecrets(nil)
+	if err == nil || !strings.Contains(err.Error(), "db vault: Unknown secret scheme 'vault'") {
+		t.Fatalf("Expected an unknown scheme error, got %v", err)
+	}
+
+	err = cfg.ResolveSecrets(map[string]SecretResolver{
+		"vault": func(ref string) (string, error) { return "from-" + ref, nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.ChildAsString("db", "password") != "hunter2" || cfg.ChildAsString("db", "token") != "tok" || cfg.ChildAsString("db", "vault") != "from-db/creds" {
+		t.Fatalf("Secrets weren't resolved")
+	}
+
+	for _, str := range []string{cfg.String(), cfg.ColoredString(), cfg.Duplicate().String(), fmt.Sprintf("%v", cfg.Child("db", "token").Values)} {
+		if strings.Contains(str, "hunter2") || strings.Contains(str, "tok\"") || !strings.Contains(str, MASKED_VALUE) {
+			t.Fatalf("Secrets should be masked: %s", str)
+		}
+	}
+	if cfg.Duplicate().ChildAsString("db", "password") != "hunter2" {
+		t.Fatal("Duplicate lost a secret")
+	}
+
+	// The other accessors see the real value too
+	typed := StringToACL(`tls: secret("v:true"), port: secret("v:5432"), ratio: secret("v:0.5"), flags: [ secret("v:false"), secret("v:1") ]`)
+	err = typed.ResolveSecrets(map[string]SecretResolver{
+		"v": func(ref string) (string, error) { return ref, nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !typed.ChildAsBool("tls") || typed.ChildAsInt("port") != 5432 || typed.ChildAsFloat("ratio") != 0.5 {
+		t.Fatalf("Typed accessors didn't use the secrets: %v %v %v", typed.ChildAsBool("tls"), typed.ChildAsInt("port"), typed.ChildAsFloat("ratio"))
+	}
+	if flags := typed.ChildAsBoolList("flags"); len(flags) != 2 || flags[0] || !flags[1] {
+		t.Fatalf("Wrong secret bool list %v", flags)
+	}
+
+	// Lists of strings too, which used to panic
+	tags := StringToACL(`tags: [ secret("env:TEST_DB_TOKEN"), "b" ]`)
+	if err := tags.ResolveSecrets(nil); err != nil {
+		t.Fatal(err)
+	}
+	if list := tags.ChildAsStringList("tags"); strings.Join(list, ",") != "tok,b" {
+		t.Fatalf("Wrong secret string list %v", list)
+	}
+}
+
+func Test_RedactKeys(t *testing.T) {
+	cfg := NewAclNode()
+	cfg.ParseString(`
+		db { host: localhost, dbPassword: hunter2 }
+		tls { cert: "/etc/app.crt", key: "/etc/app.key" }
+		credentials { user: bob, pin: 1234 }
+	`, nil)
+
+	str := cfg.RedactedString([]string{"*password*", "key", "credentials"})
+	if strings.Contains(str, "hunter2") || strings.Contains(str, "app.key") || strings.Contains(str, "1234") {
+		t.Fatalf("Values weren't redacted: %s", str)
+	}
+	if !strings.Contains(str, `"dbPassword": "<redacted>"`) || !strings.Contains(str, `"credentials": "<redacted>"`) || !strings.Contains(str, "app.crt") {
+		t.Fatalf("Wrong redaction: %s", str)
+	}
+
+	if cfg.RedactedString(nil) != cfg.String() {
+		t.Fatal("Nothing should be redacted without patterns")
+	}
+
+	type config struct {
+		DB struct {
+			Host     string `acl:"host"`
+			Password string `acl:"password,sensitive"`
+		} `acl:"db"`
+		Token   string `acl:",sensitive"`
+		Ignored string `acl:"-"`
+		API     *struct {
+			Key string `acl:"key,sensitive"`
+		}
+	}
+	keys := SensitiveKeys(config{})
+	if strings.Join(keys, " ") != "db.password Token API.key" {
+		t.Fatalf("Wrong sensitive keys: %v", keys)
+	}
+
+	_, err := Load(&Opts{
+		IgnoreCommandLine:  true,
+		IgnoreEnvironment:  true,
+		IgnoreDefaultFiles: true,
+		DumpConfig:         true,
+		DefaultText: `
+			logging { level: debug, backends dump type: memory }
+			loggly token: abc123
+			other apiThing: xyz789
+			redactKeys: "*.apiThing"
+		`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, _ := MemoryRecords("dump")
+	found := false
+	for _, r := range records {
+		msg := r.Message()
+		if strings.Contains(msg, "abc123") || strings.Contains(msg, "xyz789") {
+			t.Fatalf("The dump wasn't redacted: %s", msg)
+		}
+		found = found || strings.Contains(msg, `"token": "<redacted>"`)
+	}
+	if !found {
+		t.Fatal("The config wasn't dumped")
+	}
+}
+
+func Test_Profiles(t *testing.T) {
+	cfg := NewAclNode()
+	cfg.ParseString("a: 1, !a: 2", nil)
+	if cfg.String() != `{ "a": 2 }` {
+		t.Fatalf("A reset key should only be written once: %s", cfg.String())
+	}
+
+	text := `
+		server { port: 8080, hosts: [ a ] }
+		logging { level: debug, format: short }
+		profile production {
+			server { port: 80, hosts: [ b ] }
+			!logging { level: warning }
+		}
+		profile eu server region: eu
+	`
+
+	cfg = NewAclNode()
+	cfg.ParseString(text, nil)
+	err := cfg.ApplyProfiles("production", "nope", "eu")
+	if err == nil || err.Error() != "Unknown profile 'nope'" {
+		t.Fatalf("Expected an unknown profile error, got %v", err)
+	}
+
+	if cfg.ChildAsInt("server", "port") != 80 || cfg.ChildAsString("server", "region") != "eu" {
+		t.Fatalf("Profiles weren't applied: %s", cfg.String())
+	}
+	if hosts := cfg.ChildAsStringList("server", "hosts"); strings.Join(hosts, ",") != "a,b" {
+		t.Fatalf("Values should be added like a cascade: %v", hosts)
+	}
+	if cfg.ChildAsString("logging", "level") != "warning" || cfg.Child("logging", "format") != nil {
+		t.Fatalf("A reset key should replace the object: %s", cfg.String())
+	}
+	if cfg.Child(PROFILE_KEY) != nil || strings.Contains(cfg.String(), "profile") {
+		t.Fatalf("The profiles should be removed once applied: %s", cfg.String())
+	}
+
+	// Merging the same thing as parsing it later
+	merged := NewAclNode()
+	merged.ParseString(text, nil)
+	parsed := merged.Duplicate()
+	extra := "server port: 81, !logging level: info, more { x: 1 }"
+	other := NewAclNode()
+	other.ParseString(extra, nil)
+	merged.Merge(other)
+	parsed.ParseString(extra, nil)
+	if merged.String() != parsed.String() {
+		t.Fatalf("Merge should match parsing:\n%s\n%s", merged.String(), parsed.String())
+	}
+
+	cl := ParseCommandLine([]string{"--profile", "eu", "--profile=production"})
+	if strings.Join(cl.Profiles, ",") != "eu,production" {
+		t.Fatalf("Wrong profiles from the command line: %v", cl.Profiles)
+	}
+
+	t.Setenv("PROFTEST_PROFILE", "eu")
+	cfg, err = Load(&Opts{
+		Name:               "proftest",
+		IgnoreCommandLine:  true,
+		IgnoreDefaultFiles: true,
+		DefaultText:        text,
+		Profiles:           []string{"production"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ChildAsInt("server", "port") != 80 || cfg.ChildAsString("server", "region") != "eu" || cfg.Child("PROFILE") != nil {
+		t.Fatalf("Load didn't apply the profiles: %s", cfg.String())
+	}
+
+	// Profiles that aren't selected are removed too
+	cfg, err = LoadConfig(&Opts{DefaultText: text})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Child(PROFILE_KEY) != nil || cfg.ChildAsInt("server", "port") != 8080 {
+		t.Fatalf("Expected the base config without any profiles: %s", cfg.String())
+	}
+
+	// A profile key that's a plain value isn't a set of profiles
+	cfg, err = LoadConfig(&Opts{DefaultText: `profile: "aws-dev"`, Profiles: []string{"production"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ChildAsString(PROFILE_KEY) != "aws-dev" {
+		t.Fatalf("A plain profile value should be kept: %s", cfg.String())
+	}
+}
+
+func Test_Conditions(t *testing.T) {
+	text := `
+		server { workers: 2, port: 80 }
+		if hostname =~ "^web-" {
+			server workers: 16
+			when os == 'linux' { server !port: 8080 }
+		}
+		when os != linux { platform: other }
+		if env.DEPLOY == prod { stage: prod }
+		// if hostname == x { comment: true }
+		note: "if os == linux { quoted: true }"
+		if: 5
+	`
+
+	cfg := NewAclNode()
+	if err := cfg.ParseString(text, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unevaluated conditions survive a round trip through a string
+	again := NewAclNode()
+	if err := again.ParseString(cfg.String(), nil); err != nil || again.String() != cfg.String() {
+		t.Fatalf("Conditions didn't round trip: %v\n%s\n%s", err, cfg.String(), again.String())
+	}
+
+	err := cfg.ApplyConditions(map[string]string{"hostname": "web-01", "os": "linux", "env.DEPLOY": "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.ChildAsInt("server", "workers") != 16 || cfg.ChildAsInt("server", "port") != 8080 {
+		t.Fatalf("True blocks weren't merged: %s", cfg.String())
+	}
+	if cfg.Child("platform") != nil || cfg.ChildAsString("stage") != "prod" || cfg.Child("comment") != nil {
+		t.Fatalf("Wrong blocks were merged: %s", cfg.String())
+	}
+	if cfg.ChildAsString("note") != "if os == linux { quoted: true }" || cfg.ChildAsInt("if") != 5 {
+		t.Fatalf("Things that aren't conditions were changed: %s", cfg.String())
+	}
+	if strings.Contains(cfg.String(), "if hostname") || strings.Contains(cfg.String(), "when ") {
+		t.Fatalf("Conditions should be removed: %s", cfg.String())
+	}
+
+	cfg = NewAclNode()
+	cfg.ParseString(`if hostname =~ "(" { x: 1 }`, nil)
+	if err := cfg.ApplyConditions(nil); err == nil || !strings.Contains(err.Error(), "Bad regular expression") {
+		t.Fatalf("Expected a regexp error, got %v", err)
+	}
+
+	cfg, err = Load(&Opts{
+		IgnoreCommandLine:  true,
+		IgnoreEnvironment:  true,
+		IgnoreDefaultFiles: true,
+		Facts:              map[string]string{"role": "db"},
+		Profiles:           []string{"big"},
+		DefaultText: `
+			profile big { when role == db { pool: 50 } }
+			when arch == ` + runtime.GOARCH + ` { native: true }
+		`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ChildAsInt("pool") != 50 || !cfg.ChildAsBool("native") {
+		t.Fatalf("Load didn't apply the conditions: %s", cfg.String())
+	}
+}
+
+func Test_ParseReaderAndFS(t *testing.T) {
+	cfg := NewAclNode()
+	if err := cfg.ParseReader(strings.NewReader("a: 1"), nil); err != nil || cfg.ChildAsInt("a") != 1 {
+		t.Fatalf("ParseReader failed: %v %s", err, cfg.String())
+	}
+	err := cfg.ParseReader(strings.NewReader("a: }"), &ParseLocation{Filename: "reader"})
+	if pl, ok := err.(*ParseLocation); !ok || pl.Filename != "reader" {
+		t.Fatalf("Expected a parse error for the reader, got %v", err)
+	}
+
+	fsys := fstest.MapFS{
+		"etc/app.acl":          {Data: []byte("a: 1, b: 1")},
+		"etc/app.d/20-two.acl": {Data: []byte("!b: 3")},
+		"etc/app.d/10-one.acl": {Data: []byte("!b: 2, c: 2")},
+		"app.acl":              {Data: []byte("!c: 4")},
+		"bad.acl":              {Data: []byte("x: ]")},
+	}
+
+	cfg = NewAclNode()
+	if err := cfg.ParseFS(fsys, "etc/app.d/*.acl"); err != nil || cfg.ChildAsInt("b") != 3 {
+		t.Fatalf("ParseFS failed: %v %s", err, cfg.String())
+	}
+	if err := cfg.ParseFS(fsys, "missing.acl"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected a not exist error, got %v", err)
+	}
+	if _, ok := cfg.ParseFS(fsys, "bad.acl").(*ParseLocation); !ok {
+		t.Fatal("Expected a parse error")
+	}
+
+	cfg, err = Load(&Opts{
+		Name:              "app",
+		FS:                fsys,
+		IgnoreCommandLine: true,
+		IgnoreEnvironment: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ChildAsInt("a") != 1 || cfg.ChildAsInt("b") != 3 || cfg.ChildAsInt("c") != 4 {
+		t.Fatalf("Load didn't use the FS: %s", cfg.String())
+	}
+
+	loaded := 0
+	for _, s := range cfg.ListSources() {
+		if s.Status == SOURCE_LOADED {
+			loaded++
+		}
+		if s.Status == SOURCE_FAILED {
+			t.Fatalf("Nothing should fail: %v", cfg.ListSources())
+		}
+	}
+	if loaded != 4 {
+		t.Fatalf("Expected 4 files to be loaded: %v", cfg.ListSources())
+	}
+}
+
+func Test_LoadConfig(t *testing.T) {
+	fsys := fstest.MapFS{
+		"etc/lctest.acl": {Data: []byte("server { port: 80; host: files }\ndb password: secret(\"env:DB_PASS\")\n")},
+	}
+
+	opts := &Opts{
+		Name:        "lctest",
+		SearchPaths: []string{"/etc/{name}.acl"},
+		FS:          fsys,
+		Args:        []string{"--server.port=8080", "--", "extra"},
+		Environ:     []string{"lctest_server_host=env", "DB_PASS=hunter2"},
+		BuildInfo:   `version: "1.2.3"`,
+	}
+
+	before := BuildInfo
+	cfg, err := LoadConfig(opts)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if BuildInfo != before {
+		t.Fatalf("BuildInfo was changed")
+	}
+
+	if cfg.ChildAsInt("server", "port") != 8080 {
+		t.Errorf("Expected the port from Args: %s", cfg.String())
+	}
+	if cfg.ChildAsString("server", "host") != "env" {
+		t.Errorf("Expected the host from Environ: %s", cfg.String())
+	}
+	if cfg.ChildAsString("db", "password") != "hunter2" {
+		t.Errorf("Expected the secret from Environ: %s", cfg.String())
+	}
+	if cfg.Child(BUILDINFO_KEY) == nil || !strings.Contains(cfg.String(), `"1.2.3"`) {
+		t.Errorf("Expected the build info from Opts: %s", cfg.String())
+	}
+	if cfg.ChildAsString(ARGS_KEY) != "extra" {
+		t.Errorf("Expected the extra argument: %s", cfg.String())
+	}
+	if cfg.Child(RANDOMSEED_KEY) != nil {
+		t.Errorf("LoadConfig should not seed the random number generator")
+	}
+
+	// Without any inputs nothing comes from the process
+	cfg, err = LoadConfig(&Opts{DefaultText: "a: 1"})
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if len(cfg.ListSources()) != 0 || len(cfg.OrderedChildNames) != 1 {
+		t.Errorf("Expected only the default text: %s %v", cfg.String(), cfg.ListSources())
+	}
+
+	// The defaults aren't changed
+	defaults := NewAclNode()
+	defaults.SetValAt("x", "a")
+	_, err = LoadConfig(&Opts{Defaults: defaults, DefaultText: "a: y"})
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if len(defaults.ChildAsStringList("a")) != 1 {
+		t.Errorf("Defaults were changed: %s", defaults.String())
+	}
+
+	seed := SeedRandom(cfg)
+	if seed == 0 || int64(cfg.ChildAsInt(RANDOMSEED_KEY)) != seed {
+		t.Errorf("Expected the seed to be stored: %s", cfg.String())
+	}
+
+	// Messages stay with the config they came from, and help is ignored
+	// without a ShowHelp in the options
+	delayedMutex.Lock()
+	held := len(delayed)
+	delayedMutex.Unlock()
+
+	opts = &Opts{
+		Name:        "lctest",
+		SearchPaths: []string{"/etc/{name}.acl", "/etc/missing.acl"},
+		FS:          fsys,
+		Args:        []string{"-h", "--bogus"},
+		Environ:     []string{"DB_PASS=x"},
+		DefaultText: `if hostname == given { from: facts }`,
+		Facts:       map[string]string{"hostname": "given"},
+	}
+	for i := 0; i < 3; i++ {
+		cfg, err = LoadConfig(opts)
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %v", err)
+		}
+	}
+	delayedMutex.Lock()
+	if len(delayed) != held {
+		t.Errorf("LoadConfig added %d global messages", len(delayed)-held)
+	}
+	delayedMutex.Unlock()
+
+	messages := cfg.LoadMessages()
+	if len(messages) != 2 || messages[0].Level != logging.ERROR || !strings.Contains(messages[0].Message, "--bogus") ||
+		messages[1].Level != logging.NOTICE || !strings.Contains(messages[1].Message, "etc/missing.acl") {
+		t.Errorf("Wrong messages %v", messages)
+	}
+	if cfg.ChildAsString("from") != "facts" {
+		t.Errorf("Expected the hostname from Opts.Facts: %s", cfg.String())
+	}
+
+	helped := 0
+	opts.ShowHelp = func() { helped++ }
+	_, err = LoadConfig(opts)
+	if err != nil || helped != 1 {
+		t.Errorf("Expected Opts.ShowHelp to be called once, got %d: %v", helped, err)
+	}
+
+	// Defaults from an fs.FS still see the real hostname, unless host facts
+	// are turned off
+	hostname, _ := os.Hostname()
+	fsys["etc/hosttest.acl"] = &fstest.MapFile{Data: []byte(`if hostname == "` + hostname + `" { matched: true }`)}
+	opts = &Opts{Name: "hosttest", SearchPaths: []string{"/etc/{name}.acl"}, FS: fsys}
+	cfg, err = LoadConfig(opts)
+	if err != nil || (hostname != "" && !cfg.ChildAsBool("matched")) {
+		t.Errorf("Expected the hostname fact with an FS: %v %s", err, cfg.String())
+	}
+	opts.IgnoreHostFacts = true
+	cfg, err = LoadConfig(opts)
+	if err != nil || (hostname != "" && cfg.ChildAsBool("matched")) {
+		t.Errorf("Expected no hostname fact with IgnoreHostFacts: %v %s", err, cfg.String())
+	}
+}
+
+func Test_ParseErrors(t *testing.T) {
+	data := `a: 1
+b: @
+c: 2
+d: ]
+server {
+	f: @
+	g: 4
+}
+list: [ 1, 2, @
+	3 ]
+h: 5
+`
+	cfg := NewAclNode()
+	err := cfg.ParseString(data, &ParseLocation{Filename: "multi"})
+	errs, ok := err.(ParseErrors)
+	if !ok {
+		t.Fatalf("Expected ParseErrors but got %T %v", err, err)
+	}
+	if len(errs) != 4 {
+		t.Fatalf("Expected 4 errors but got %d:\n%v", len(errs), errs)
+	}
+	for ix, line := range []int{1, 3, 5, 8} {
+		if errs[ix].Line != line || errs[ix].Filename != "multi" {
+			t.Errorf("Expected error %d on line %d: %v", ix, line, errs[ix])
+		}
+	}
+	if len(strings.Split(err.Error(), "\n")) != 4 {
+		t.Errorf("Expected one line per error: %v", err)
+	}
+
+	var pl *ParseLocation
+	if !errors.As(err, &pl) || pl != errs[0] {
+		t.Errorf("Expected errors.As to find the first error")
+	}
+	if len(ParseErrorsOf(err)) != 4 || len(ParseErrorsOf(errs[0])) != 1 || ParseErrorsOf(fs.ErrNotExist) != nil {
+		t.Errorf("ParseErrorsOf didn't give the expected lists")
+	}
+
+	// Everything else was still parsed in the right place
+	if cfg.ChildAsInt("a") != 1 || cfg.ChildAsInt("c") != 2 || cfg.ChildAsInt("h") != 5 {
+		t.Errorf("Expected the top level values: %s", cfg.String())
+	}
+	if cfg.ChildAsInt("server", "g") != 4 || cfg.Child("g") != nil {
+		t.Errorf("Expected g inside server: %s", cfg.String())
+	}
+	if fmt.Sprint(cfg.Child("list").Values) != "[1 2]" {
+		t.Errorf("Expected the array up to the error: %s", cfg.String())
+	}
+
+	// The rest of an array with an error is skipped so the keys after it
+	// aren't taken as values
+	cfg = NewAclNode()
+	err = cfg.ParseString("x {\n  a: [1, @@, 3]\n  c: 2\n}\ny: 4\n", nil)
+	if len(ParseErrorsOf(err)) != 1 {
+		t.Errorf("Expected one error but got %v", err)
+	}
+	if fmt.Sprint(cfg.Child("x", "a").Values) != "[1]" || cfg.ChildAsInt("x", "c") != 2 || cfg.ChildAsInt("y") != 4 {
+		t.Errorf("Expected x.a, x.c and y: %s", cfg.String())
+	}
+
+	// Including one over several lines with objects in it
+	cfg = NewAclNode()
+	err = cfg.ParseString("a: [\n  { b: 1 }\n  @\n  [ 2, 3 ]\n]\nc: 4\nd: @\n", nil)
+	errs = ParseErrorsOf(err)
+	if len(errs) != 2 || errs[0].Line != 2 || errs[1].Line != 6 {
+		t.Errorf("Expected errors on lines 2 and 6 but got %v", err)
+	}
+	if cfg.ChildAsInt("c") != 4 || len(cfg.Child("a").Values) != 1 {
+		t.Errorf("Expected a and c: %s", cfg.String())
+	}
+
+	// An error in a nested object carries on in that object
+	cfg = NewAclNode()
+	err = cfg.ParseString("x {\n  y {\n    a: @\n    b: 1 }\n  c: 2\n}\nd: 3\n", nil)
+	if len(ParseErrorsOf(err)) != 1 {
+		t.Errorf("Expected one error but got %v", err)
+	}
+	if cfg.ChildAsInt("x", "y", "b") != 1 || cfg.ChildAsInt("x", "c") != 2 || cfg.ChildAsInt("d") != 3 {
+		t.Errorf("Expected x.y.b, x.c and d: %s", cfg.String())
+	}
+
+	// A stray closing brace doesn't stop things either
+	cfg = NewAclNode()
+	err = cfg.ParseString("a: 1\n}\nb: 2\n}}\nc: 3", nil)
+	if len(ParseErrorsOf(err)) != 3 || cfg.ChildAsInt("b") != 2 || cfg.ChildAsInt("c") != 3 {
+		t.Errorf("Expected 3 errors and b and c: %v %s", err, cfg.String())
+	}
+
+	// Load reports the errors from every step of the cascade
+	fsys := fstest.MapFS{
+		"etc/pe.acl":     {Data: []byte("a: @\nb: 1\n")},
+		"etc/pe.d/1.acl": {Data: []byte("c: 2\nd: ]\n")},
+		"etc/pe.d/2.acl": {Data: []byte("e: 3\n")},
+	}
+	_, err = LoadConfig(&Opts{
+		Name:        "pe",
+		SearchPaths: []string{"/etc/{name}.acl", "/etc/{name}.d/*.acl"},
+		FS:          fsys,
+		DefaultText: "x: ]",
+		Args:        []string{"y: @"},
+		BuildInfo:   "z: @",
+	})
+	var files []string
+	for _, l := range ParseErrorsOf(err) {
+		files = append(files, l.Filename)
+	}
+	if strings.Join(files, " ") != "DefaultText etc/pe.acl etc/pe.d/1.acl CMDLINE(0) BuildInfo" {
+		t.Errorf("Expected errors from every step but got %v", err)
+	}
+}
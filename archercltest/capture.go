@@ -0,0 +1,115 @@
+/*
+Package archercltest has helpers for tests that want to check what was logged.
+
+CaptureLogs replaces the logging configuration with one that keeps every record in
+memory for the rest of the test, and puts the previous configuration back when the
+test is done. The previous backends themselves are put back rather than new ones
+built from their config, so files and async goroutines they had are still in use.
+
+	func TestSomething(t *testing.T) {
+		logs := archercltest.CaptureLogs(t)
+
+		doSomething()
+
+		if !logs.Contains(logging.WARNING, "db", "retrying") {
+			t.Fatal("Expected a warning about retrying")
+		}
+		logs.RequireNoErrors()
+	}
+
+Since logging is configured for the whole program, tests that capture logs can't be
+run with t.Parallel().
+*/
+package archercltest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/eyethereal/go-archercl"
+	"github.com/op/go-logging"
+)
+
+// The name of the memory backend that CaptureLogs installs
+const CAPTURE_BACKEND = "archercltest_capture"
+
+// How many records a Capture holds before it starts dropping the oldest ones
+const CAPTURE_SIZE = 10000
+
+// The records logged since CaptureLogs was called
+type Capture struct {
+	t testing.TB
+}
+
+const captureACL = `
+logging {
+	level: debug
+	backends ` + CAPTURE_BACKEND + ` {
+		type: memory
+		format: "%{message}%{fields}"
+	}
+}
+`
+
+// Sends every record at every level to memory until the end of the test, at
+// which point the previous logging setup is restored with RestoreLogging.
+func CaptureLogs(t testing.TB) *Capture {
+	t.Helper()
+
+	previous := archercl.SaveLogging()
+
+	cfg := archercl.StringToACL(captureACL)
+	cfg.SetValAt(CAPTURE_SIZE, "logging", "backends", CAPTURE_BACKEND, "size")
+	err := archercl.SetLoggingConfig(cfg)
+	if err != nil {
+		t.Fatalf("Unable to capture logs: %v", err)
+	}
+
+	t.Cleanup(func() {
+		archercl.RestoreLogging(previous)
+	})
+
+	return &Capture{
+		t: t,
+	}
+}
+
+// All of the records captured so far, oldest first.
+func (c *Capture) Records() []*logging.Record {
+	records, _ := archercl.MemoryRecords(CAPTURE_BACKEND)
+	return records
+}
+
+// Reports if there is a record at exactly level from module with substring
+// somewhere in its message. An empty module matches any module.
+func (c *Capture) Contains(level logging.Level, module string, substring string) bool {
+	for _, r := range c.Records() {
+		if r.Level != level {
+			continue
+		}
+		if len(module) > 0 && r.Module != module {
+			continue
+		}
+		if strings.Contains(r.Formatted(0), substring) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fails the test right away if anything was logged at ERROR or CRITICAL,
+// listing each of those records.
+func (c *Capture) RequireNoErrors() {
+	c.t.Helper()
+
+	failed := false
+	for _, r := range c.Records() {
+		if r.Level <= logging.ERROR {
+			c.t.Errorf("%s %s: %s", r.Level, r.Module, r.Formatted(0))
+			failed = true
+		}
+	}
+	if failed {
+		c.t.FailNow()
+	}
+}
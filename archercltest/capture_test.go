@@ -0,0 +1,68 @@
+package archercltest
+
+import (
+	"testing"
+
+	"github.com/eyethereal/go-archercl"
+	"github.com/op/go-logging"
+)
+
+// Records failures instead of failing the real test
+type fakeT struct {
+	testing.TB
+	errors int
+	failed bool
+}
+
+func (f *fakeT) Helper() {}
+
+func (f *fakeT) Errorf(format string, args ...interface{}) {
+	f.errors++
+}
+
+func (f *fakeT) FailNow() {
+	f.failed = true
+}
+
+func Test_CaptureLogs(t *testing.T) {
+	archercl.SetLoggingConfig(archercl.StringToACL(`logging { level: warning, backends before type: memory }`))
+	before := archercl.GetBackend("before")
+
+	t.Run("capture", func(t *testing.T) {
+		logs := CaptureLogs(t)
+
+		lgr := archercl.Logger("captured")
+		lgr.Debug("debug is captured")
+		archercl.NewModuleLogger("other").With("id", 7).Warningf("%d tries", 3)
+
+		if len(logs.Records()) != 2 {
+			t.Fatalf("Expected 2 records, got %d", len(logs.Records()))
+		}
+		if !logs.Contains(logging.DEBUG, "captured", "is captured") {
+			t.Fatal("The debug record wasn't found")
+		}
+		if !logs.Contains(logging.WARNING, "", "3 tries id=7") {
+			t.Fatal("The warning wasn't found by substring")
+		}
+		if logs.Contains(logging.INFO, "captured", "is captured") || logs.Contains(logging.DEBUG, "other", "") {
+			t.Fatal("Contains should match the level and module")
+		}
+		logs.RequireNoErrors()
+
+		fake := &fakeT{TB: t}
+		logs.t = fake
+		lgr.Error("bad")
+		lgr.Critical("worse")
+		logs.RequireNoErrors()
+		if fake.errors != 2 || !fake.failed {
+			t.Fatalf("Expected 2 errors and a failure, got %d and %v", fake.errors, fake.failed)
+		}
+	})
+
+	if archercl.GetBackend("before") != before || archercl.GetBackend(CAPTURE_BACKEND) != nil {
+		t.Fatal("The previous backends weren't restored")
+	}
+	if archercl.GlobalLevel() != logging.WARNING || archercl.Logger("captured").IsEnabledFor(logging.INFO) {
+		t.Fatal("The previous levels weren't restored")
+	}
+}
@@ -0,0 +1,126 @@
+package archercl
+
+import (
+	"sort"
+
+	"github.com/op/go-logging"
+)
+
+// Creates a backend from its node in the "logging backends" block of the
+// config. The node is the whole block for the backend, so it also contains
+// the type, format, level, and so on, which are all taken care of outside of
+// the factory.
+type BackendFactory func(node *AclNode) (logging.Backend, error)
+
+// The factories for each backend type. registryMutex must be held, and
+// setLoggingConfig works from a copy, see snapshotRegistry.
+var backendTypes = map[string]BackendFactory{
+	"memory":        makeMemoryBackend,
+	"channelMemory": makeChannelMemoryBackend,
+	"stdout":        makeStdoutBackend,
+	"stderr":        makeStderrBackend,
+	"file":          makeFileBackend,
+	"syslog":        makeSyslogBackend,
+	"remoteSyslog":  makeRemoteSyslogBackend,
+	"loggly":        makeLogglyBackend,
+	"delayed":       makeDelayedBackend,
+}
+
+// Backends that were created by the application rather than from the config,
+// keyed by name. registryMutex must be held.
+var extraBackends = make(map[string]logging.Backend)
+
+// Adds a new type of backend which can then be used in the "logging backends"
+// block of the config just like the built in types. This is normally called
+// from an init() function
+//
+//	func init() {
+//		archercl.RegisterBackendType("kafka", func(node *archercl.AclNode) (logging.Backend, error) {
+//			return NewKafkaBackend(node.ChildAsString("brokers"), node.ChildAsString("topic"))
+//		})
+//	}
+//
+// and then configured with
+//
+//	logging backends events {
+//		type: kafka
+//		brokers: "kafka-1:9092"
+//		topic: "logs"
+//		level: warning
+//	}
+//
+// Registering a name that is already in use replaces the existing type,
+// including the built in ones. A nil factory removes the type. Only configs
+// set after this is called will see the change.
+func RegisterBackendType(name string, factory BackendFactory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if factory == nil {
+		delete(backendTypes, name)
+		return
+	}
+	backendTypes[name] = factory
+}
+
+// Attaches a backend that the application has already created, such as a UI
+// widget, so that it receives log records the same as the configured ones.
+// The name is used to find its formatting, level, and module rules in the
+// "logging backends" block of the config. A type isn't needed there, and if
+// one is given it is ignored.
+//
+// The backend stays attached through every later call to SetLoggingConfig.
+// Load attaches everything in Opts.ExtraBackends with this.
+func AddExtraBackend(name string, be logging.Backend) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	extraBackends[name] = be
+}
+
+// Detaches a backend added with AddExtraBackend. It keeps receiving records
+// until the next call to SetLoggingConfig.
+func RemoveExtraBackend(name string) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	delete(extraBackends, name)
+}
+
+// A copy of the backend types and extra backends, so that backends can be
+// built without holding registryMutex. A factory that logs or looks up a
+// backend needs the lock itself.
+type backendRegistry struct {
+	types  map[string]BackendFactory
+	extras map[string]logging.Backend
+}
+
+func snapshotRegistry() *backendRegistry {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	reg := &backendRegistry{
+		types:  make(map[string]BackendFactory, len(backendTypes)),
+		extras: make(map[string]logging.Backend, len(extraBackends)),
+	}
+	for name, factory := range backendTypes {
+		reg.types[name] = factory
+	}
+	for name, be := range extraBackends {
+		reg.extras[name] = be
+	}
+	return reg
+}
+
+// The names of the extra backends which don't have a block in the config.
+func (reg *backendRegistry) unconfiguredExtras(beACL *AclNode) []string {
+	names := make([]string, 0)
+	for name := range reg.extras {
+		if beACL.Child(name) == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,308 @@
+package archercl
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/op/go-logging"
+)
+
+// What a DelayedBackend does with a new record when it is already holding
+// as many as it is allowed to.
+type DropPolicy int
+
+const (
+	// Throw away the oldest record to make room for the new one
+	DROP_OLDEST DropPolicy = iota
+
+	// Throw away the new record
+	DROP_NEWEST
+)
+
+// The size of the queue used by an asynchronous DelayedBackend when it
+// wasn't given a maximum
+const DEFAULT_ASYNC_QUEUE = 1000
+
+// A DelayedBackend holds on to log records until a real backend is provided
+// with SetRealBackend, at which point the held records are forwarded to it
+// and everything after that goes straight through.
+//
+// In async mode the records are always queued and a separate goroutine hands
+// them to the real backend. This keeps a slow backend, such as a UI widget,
+// from ever holding up the code that is doing the logging. If the real backend
+// falls too far behind, records are dropped according to the Policy.
+//
+// All of the methods are safe to call from multiple goroutines.
+type DelayedBackend struct {
+	// The maximum number of records to hold. 0 means none are held until there
+	// is a real backend and <0 means there is no limit. In async mode the
+	// queue always has a limit, so 0 or <0 means DEFAULT_ASYNC_QUEUE instead.
+	MaxCache int
+
+	// Which records to drop when MaxCache is reached
+	Policy DropPolicy
+
+	mutex       sync.Mutex
+	cond        *sync.Cond
+	realBackend logging.Backend
+	async       bool
+	closed      bool
+	running     bool
+
+	// A ring of held records. count of them starting at head are valid.
+	ring  []*logging.Record
+	head  int
+	count int
+
+	dropped uint64
+}
+
+// Creates a synchronous DelayedBackend that drops the oldest records.
+func NewDelayedBackend(maxCache int) *DelayedBackend {
+	d := &DelayedBackend{
+		MaxCache: maxCache,
+		Policy:   DROP_OLDEST,
+	}
+	d.cond = sync.NewCond(&d.mutex)
+
+	return d
+}
+
+// Deprecated: This is the original misspelled name of NewDelayedBackend.
+func NewDelayedBacked(maxCache int) *DelayedBackend {
+	return NewDelayedBackend(maxCache)
+}
+
+// Creates a DelayedBackend in async mode which forwards to be, which may be
+// nil if the real backend will be set later.
+func NewAsyncBackend(be logging.Backend, maxQueue int, policy DropPolicy) *DelayedBackend {
+	d := NewDelayedBackend(maxQueue)
+	d.Policy = policy
+	d.SetAsync(true)
+	d.SetRealBackend(be)
+
+	return d
+}
+
+// Turns async mode on or off. Turning it off waits for anything that has
+// been queued to be delivered first.
+func (d *DelayedBackend) SetAsync(async bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if async == d.async {
+		return
+	}
+	d.async = async
+
+	if async {
+		if !d.running {
+			d.running = true
+			go d.process()
+		}
+		return
+	}
+
+	d.cond.Broadcast()
+	for d.running {
+		d.cond.Wait()
+	}
+}
+
+func (d *DelayedBackend) SetRealBackend(be logging.Backend) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.realBackend = be
+	if be == nil {
+		return
+	}
+
+	if d.async {
+		d.cond.Broadcast()
+		return
+	}
+
+	// The lock is held while the backlog is written so anything logged at
+	// the same time comes out after it
+	for d.count > 0 {
+		r := d.pop()
+		_ = be.Log(r.Level, 0, r)
+	}
+}
+
+// The number of records that have been thrown away because there was no room
+// to hold them.
+func (d *DelayedBackend) Dropped() uint64 {
+	return atomic.LoadUint64(&d.dropped)
+}
+
+// The number of records currently being held.
+func (d *DelayedBackend) Pending() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.count
+}
+
+// Stops the async goroutine after everything queued has been delivered to
+// the real backend. Records logged after Close are dropped.
+func (d *DelayedBackend) Close() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.closed = true
+	d.cond.Broadcast()
+	for d.running {
+		d.cond.Wait()
+	}
+}
+
+func (d *DelayedBackend) Log(level logging.Level, depth int, r *logging.Record) error {
+	d.mutex.Lock()
+
+	if d.closed {
+		d.mutex.Unlock()
+		atomic.AddUint64(&d.dropped, 1)
+		return nil
+	}
+
+	be := d.realBackend
+	if be != nil && !d.async {
+		d.mutex.Unlock()
+		return be.Log(level, depth+1, r)
+	}
+	defer d.mutex.Unlock()
+
+	limit := d.MaxCache
+	if d.async && limit <= 0 {
+		limit = DEFAULT_ASYNC_QUEUE
+	}
+	if limit == 0 {
+		return nil
+	}
+
+	// Once the record is held the call stack it came from is gone, so
+	// anything in the format that depends on it has to be worked out now.
+	r.Formatted(depth + 1)
+
+	if limit > 0 && d.count >= limit {
+		atomic.AddUint64(&d.dropped, 1)
+		if d.Policy == DROP_NEWEST {
+			return nil
+		}
+		d.pop()
+	}
+
+	d.push(r)
+	d.cond.Broadcast()
+
+	return nil
+}
+
+// Delivers records in async mode. It runs until async mode is turned off or
+// the backend is closed.
+func (d *DelayedBackend) process() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for {
+		for d.async && !d.closed && (d.count == 0 || d.realBackend == nil) {
+			d.cond.Wait()
+		}
+
+		if d.realBackend == nil || d.count == 0 {
+			break
+		}
+
+		r := d.pop()
+		be := d.realBackend
+
+		d.mutex.Unlock()
+		_ = be.Log(r.Level, 0, r)
+		d.mutex.Lock()
+
+		// Close and SetAsync may be waiting for the queue to empty
+		d.cond.Broadcast()
+	}
+
+	d.running = false
+	d.cond.Broadcast()
+}
+
+// Adds a record to the end of the ring, growing it if needed. The mutex
+// must be held.
+func (d *DelayedBackend) push(r *logging.Record) {
+	if d.count == len(d.ring) {
+		size := 2 * len(d.ring)
+		if size == 0 {
+			size = 16
+		}
+		if d.MaxCache > 0 && size > d.MaxCache {
+			size = d.MaxCache
+		}
+		if size <= d.count {
+			size = d.count + 1
+		}
+
+		next := make([]*logging.Record, size)
+		for i := 0; i < d.count; i++ {
+			next[i] = d.ring[(d.head+i)%len(d.ring)]
+		}
+		d.ring = next
+		d.head = 0
+	}
+
+	d.ring[(d.head+d.count)%len(d.ring)] = r
+	d.count++
+}
+
+// Removes the oldest record from the ring. The mutex must be held and
+// count must be > 0.
+func (d *DelayedBackend) pop() *logging.Record {
+	r := d.ring[d.head]
+	d.ring[d.head] = nil
+	d.head = (d.head + 1) % len(d.ring)
+	d.count--
+
+	return r
+}
+
+func makeDelayedBackend(node *AclNode) (logging.Backend, error) {
+	async := node.ChildAsBool("async")
+
+	// Without a maxCache everything is held, except that an async queue is
+	// never unbounded. An explicit 0 is kept, since it means nothing is held,
+	// or DEFAULT_ASYNC_QUEUE for async.
+	maxCache := -1
+	if async {
+		maxCache = DEFAULT_ASYNC_QUEUE
+	}
+	if mc := node.Child("maxCache"); mc != nil {
+		maxCache = mc.AsInt()
+		if async && maxCache < 0 {
+			return nil, fmt.Errorf("An async delayed backend can't have a maxCache of %d", maxCache)
+		}
+	}
+
+	d := NewDelayedBackend(maxCache)
+
+	drop := node.ChildAsString("drop")
+	switch drop {
+	case "", "oldest":
+		d.Policy = DROP_OLDEST
+
+	case "newest":
+		d.Policy = DROP_NEWEST
+
+	default:
+		return nil, fmt.Errorf("Unknown drop policy '%s' for delayed backend", drop)
+	}
+
+	if async {
+		d.SetAsync(true)
+	}
+
+	return d, nil
+}
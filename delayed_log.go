@@ -2,48 +2,78 @@ package archercl
 
 import (
 	"github.com/op/go-logging"
+	"sync"
 )
 
-type delayedMessage struct {
-	level   logging.Level
-	message string
+// Something noticed while loading a config, such as a file that couldn't be
+// opened or an unknown command line flag, which can't be logged until
+// logging has been configured. See LoadMessages.
+type LoadMessage struct {
+	Level   logging.Level
+	Message string
 }
 
-var delayed = make([]*delayedMessage, 0, 5)
+var delayed = make([]LoadMessage, 0, 5)
+
+var delayedMutex sync.Mutex
 
 func logDelayed(level logging.Level, msg string) {
-	dm := &delayedMessage{
-		level:   level,
-		message: msg,
+	delayedMutex.Lock()
+	delayed = append(delayed, LoadMessage{Level: level, Message: msg})
+	delayedMutex.Unlock()
+}
+
+// Keeps the message on a root node that LoadConfig built, so each config
+// has its own, and otherwise holds it with the global ones until logging is
+// configured.
+func (node *AclNode) logDelayed(level logging.Level, msg string) {
+	if node != nil && node.collectMessages {
+		node.messages = append(node.messages, LoadMessage{Level: level, Message: msg})
+		return
+	}
+	logDelayed(level, msg)
+}
+
+// The messages from loading this config, which is only set on the root node
+// returned by LoadConfig or Load. ConfigureLogging logs them when the config
+// is dumped.
+func (node *AclNode) LoadMessages() []LoadMessage {
+	if node == nil {
+		return nil
 	}
-	delayed = append(delayed, dm)
+	return append([]LoadMessage(nil), node.messages...)
 }
 
-func outputDelayedLog(lgr *logging.Logger) {
+// Logs the held global messages followed by the extra ones
+func outputDelayedLog(lgr *logging.Logger, extra []LoadMessage) {
 
-	for _, d := range delayed {
-		switch d.level {
+	// Take them all at once so nothing added while they are being logged
+	// is lost
+	delayedMutex.Lock()
+	messages := delayed
+	delayed = make([]LoadMessage, 0, 5)
+	delayedMutex.Unlock()
+
+	for _, d := range append(messages, extra...) {
+		switch d.Level {
 		case logging.CRITICAL:
-			lgr.Critical(d.message)
+			lgr.Critical(d.Message)
 
 		case logging.ERROR:
-			lgr.Error(d.message)
+			lgr.Error(d.Message)
 
 		case logging.WARNING:
-			lgr.Warning(d.message)
+			lgr.Warning(d.Message)
 
 		case logging.NOTICE:
-			lgr.Notice(d.message)
+			lgr.Notice(d.Message)
 
 		case logging.INFO:
-			lgr.Info(d.message)
+			lgr.Info(d.Message)
 
 		default:
-			lgr.Debug(d.message)
+			lgr.Debug(d.Message)
 
 		}
 	}
-
-	// Clear them
-	delayed = make([]*delayedMessage, 0, 5)
 }
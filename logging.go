@@ -83,6 +83,30 @@
 			}
 		}
 
+	Every backend block also accepts a level, a list of modules to include or exclude,
+	and per-module levels that apply only to that backend. This sends only warnings
+	and above to syslog while still sending debug output for the web module to the
+	console. See FilterBackend for how these interact with the module levels.
+
+		logging {
+			level: info
+
+			backends {
+				syslog {
+					type: syslog
+					level: warning
+				}
+
+				console {
+					type: stdout
+					modules {
+						exclude: [ noisy ]
+						web level: debug
+					}
+				}
+			}
+		}
+
 	Here is a full example including all backend types and all options for each of them.
 	You wouldn't ever do this in practice of course. Notice that all the logging
 	configuration happens inside the "logging" object
@@ -102,8 +126,10 @@
 			// The global format that is used by all backends unless another format
 			// is specified in the definition of the individual backend. The value
 			// shown here is the default value if one is not given. See go-logging
-			// for more info about available commands.
-			format: "%{time:15:04:05.000} %{shortfunc:10.10s} %{level:4.4s} %{module:8.8s} ▶ %{message}"
+			// for more info about available commands. Instead of a format string
+			// one of the presets can be named, as in "preset:compact". The presets
+			// are compact, dev-color, iso8601, and logfmt. See FormatPresets.
+			format: "%{time:15:04:05.000} %{shortfunc:10.10s} %{level:4.4s} %{module:8.8s} ▶ %{message}%{fields}"
 
 			// The modules object is used to define per-module options, which currently
 			// is just the log level for that module.
@@ -114,6 +140,12 @@
 
 				// The shorter ACL syntax can be used like this
 				web level : debug
+
+				// Modules with dotted or slashed names, like db.pool, get their
+				// level from the nearest ancestor that has one, and patterns can
+				// match whole groups of modules. See ModuleAncestors.
+				db level: warning
+				"http.*" level: info
 			}
 
 
@@ -125,9 +157,15 @@
 				// Just hold things in memory
 				memory {
 					type: memory
+					level: debug // Any backend can have its own level and modules block
 					size: 1000	// Number of lines to hold onto
 					forTesting: false // See the go-logging docs
 					format: "%{time:15:04:05} %{message}"
+
+					// Any backend can also be protected from floods of the same
+					// message. See LimitBackend for details.
+					rateLimit { perSecond: 100, burst: 200 }
+					sample { first: 10, thereafter: 100 }
 				}
 
 				// Same as memory, but using a channel to store the data
@@ -176,6 +214,15 @@
 					format: "%{time:15:04:05} %{message}"
 				}
 
+				// Sends RFC 5424 or RFC 3164 messages to a syslog server over
+				// udp, tcp, or tls. See RemoteSyslogBackend for all the options.
+				remote_syslog {
+					type: remoteSyslog
+					network: tcp
+					address: "logs.example.com:514"
+					appName: "myapp"
+				}
+
 				loggly {
 					type: loggly
 					// TODO: Finish documenting this
@@ -195,25 +242,57 @@
 					maxCache: 0  // max messages to hold until the real backend comes along.
  							     // 0 = don't cache anything, just drop them if there is no real backend
                                  // <0 = no limit, hold onto all messages. This is the default.
+                                 // With async the default is 1000 and <0 isn't allowed.
+					drop: oldest // When maxCache is reached drop the oldest or the newest messages
+					async: false // Deliver to the real backend from a separate goroutine so a
+					             // slow backend, like a UI, never holds up the logging call.
 					format: "%{time:15:04:05} %{message}"
 				}
 
 			}
 		}
 
+	Other types of backends can be added with RegisterBackendType and are then configured
+	in the backends block the same as the ones above. Backends the application creates itself
+	can be attached with AddExtraBackend, or Opts.ExtraBackends, and get their format and
+	levels from a block with the same name, which doesn't need a type.
+
+	Code using log/slog can share all of this through a SlogHandler, either with
+	SlogLogger("mymodule") or by calling SetSlogDefault. The module for a slog record comes
+	from an attribute or the logger's groups as set in the "slog" block of the logging config.
+
+	A ModuleLogger from NewModuleLogger("mymodule") has the same methods as the logger above
+	plus With(key, value, ...) to attach structured fields such as a request ID. Formats show
+	them with the %{fields} verb, which the default format has right after %{message}, and
+	the loggly backend sends them as their own keys. ContextWithLogger and LoggerFromContext
+	pass one along through a context.Context.
+
+	Libraries that write to the standard log package can be brought in with RedirectStdLog
+	or a "stdlib" block in the logging config, and ones that want an io.Writer can be given
+	one from WriterFor.
+
+	The records in a memory or channelMemory backend can be looked at over HTTP with the
+	handler from LogTailHandler, which can also stream new records as Server-Sent Events.
+
 */
 package archercl
 
 import (
 	"fmt"
+	"io"
 	"github.com/op/go-logging"
-	"log"
 	"log/syslog"
 	"os"
+	"sync"
 )
 
 const DEFAULT_FORMAT_STRING = "%{time:15:04:05.000} %{shortfunc:10.10s} %{level:4.4s} %{module:8.8s} ▶ %{message}"
 
+// The format used when the config doesn't give one. It's DEFAULT_FORMAT_STRING
+// with the fields from a ModuleLogger on the end, which only works with
+// NewFormatter and not with go-logging's own formatters.
+const DEFAULT_FIELDS_FORMAT_STRING = DEFAULT_FORMAT_STRING + "%{fields}"
+
 //const DEFAULT_FORMAT_STRING = "%{color}%{time:15:04:05.000} %{shortfunc:10.10s} %{level:4.4s}%{color:reset} %{module:8.8s} ▶ %{message}"
 
 //const DEFAULT_FORMAT_STRING = "%{time:15:04:05.000} %{shortfunc:.10s} %{level:.4s}%{color:reset} %{module:.8s} ▶ %{message}"
@@ -229,21 +308,49 @@ const COLOR_LOGGING_ACL = `
 		logging level: "debug"
 	`
 
+// All of the package level logging state below is protected by this. The
+// hot path of actually logging something never needs it since everything
+// it needs is kept in the dispatcher.
+var registryMutex sync.RWMutex
+
+// Only one config is built and put in place at a time. The backends are
+// built holding just this, so a factory can log or call GetBackend.
+var configMutex sync.Mutex
+
 var loggers = make(map[string]*logging.Logger)
 
 var loggingACL *AclNode
 
-// Get the logger associated with a given module name.
+// The whole config that loggingACL came from, so that a logging node can be
+// added to it if one is needed later.
+var loggingRoot *AclNode
+
+// Get the logger associated with a given module name. This is safe to call
+// from any goroutine, including while the logging config is being changed.
+// Calling it again with the same name returns the same logger. Names can be
+// hierarchical, like "db.pool", in which case the module gets its level from
+// the nearest configured ancestor. See ModuleAncestors.
 func Logger(name string) (logger *logging.Logger) {
 
 	// fmt.Printf("Logger(%s, )\n", name)
 
-	logger = logging.MustGetLogger(name)
+	// Asking for the same module again gets the same logger
+	registryMutex.RLock()
+	logger = loggers[name]
+	registryMutex.RUnlock()
+	if logger != nil {
+		return logger
+	}
 
-	if loggers[name] != nil && loggers[name] != logger {
-		loggers[name].Notice("This logger has been replaced by a new one in the central configuration manager.")
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	logger = loggers[name]
+	if logger != nil {
+		return logger
 	}
 
+	logger = logging.MustGetLogger(name)
 	loggers[name] = logger
 
 	if loggingACL != nil {
@@ -257,17 +364,18 @@ func Logger(name string) (logger *logging.Logger) {
 // format was specified, this backend is further wrapped, but this function will
 // always return the basic type which can then be coercised into whatever you
 // need if you want to further configure this. One use here is to retrieve the
-// memory backend instance so you can get at the messages it contains.
+// memory backend instance so you can get at the messages it contains, although
+// MemoryRecords does that safely while other goroutines are logging.
 //
 // The other common use is to get a delayed backed end so you can set the
 // real backend which it should forward messages on to like so
 //
-//		if be, ok := archercl.GetBackend("ui").(archercl.DelayedBacked); ok {
+//		if be, ok := archercl.GetBackend("ui").(*archercl.DelayedBackend); ok {
 //			be.SetRealBackend(myUiLogger)
 //		}
 //
 func GetBackend(name string) logging.Backend {
-	holder := backends[name]
+	holder := getBackendHolder(name)
 
 	if holder == nil {
 		return nil
@@ -276,6 +384,13 @@ func GetBackend(name string) logging.Backend {
 	return holder.Backend
 }
 
+func getBackendHolder(name string) *BackendHolder {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	return backends[name]
+}
+
 type BackendHolder struct {
 	// The name as given in the config file
 	Name string
@@ -285,37 +400,144 @@ type BackendHolder struct {
 	// Backend is the underlying backend, so Memory, File, etc.
 	Backend logging.Backend
 
-	// Formatted is either a reference to the Backend directly or it might
+	// Formatted is either a reference to the Backend directly, possibly
+	// behind a lock if the Backend isn't safe for concurrent use, or it might
 	// be a StringFormatter wrapper which applies custom formatting to
 	// the message. It's held separately because this is what is actually
 	// given to loggers, but if you want like history from a memory logger
 	// you need the unwrapped version.
 	Formatted logging.Backend
+
+	// Limit wraps Formatted when the backend was configured with rate
+	// limiting or sampling. It is nil otherwise.
+	Limit *LimitBackend
+
+	// Filter wraps Limit, or Formatted if there is no Limit, when the backend
+	// was configured with its own level or module rules. It is nil otherwise.
+	Filter *FilterBackend
+
+	// Set for memory backends so their records can be read safely
+	locked *lockedBackend
+}
+
+// Output is the backend that is actually attached to the loggers, which is
+// the outermost of the Filter, Limit, or Formatted backends.
+func (holder *BackendHolder) Output() logging.Backend {
+	if holder.Filter != nil {
+		return holder.Filter
+	}
+
+	return holder.limited()
+}
+
+func (holder *BackendHolder) limited() logging.Backend {
+	if holder.Limit != nil {
+		return holder.Limit
+	}
+
+	return holder.Formatted
 }
 
 var backends = make(map[string]*BackendHolder)
 
 var globalLevel logging.Level
 
-func configureLogger(modName string, logger *logging.Logger) {
+// The formatter used by backends that don't have a format of their own
+var globalFormatter logging.Formatter
+
+// Returns the level a module has been configured for and whether the module
+// is known at all.
+func configuredLevel(modName string) (logging.Level, bool) {
+	return dispatcher.configuredLevel(modName)
+}
+
+// Works out the level a module is configured for and the level that has to
+// be let through to the backends for it, which can be more verbose if a
+// backend has its own override for the module. registryMutex must be held.
+func moduleLevel(modName string) (configured logging.Level, gate logging.Level) {
 
 	// fmt.Printf("Configuring logger '%s'\n", modName)
-	moduleCfg := loggingACL.Child("modules", modName)
+	moduleCfg := moduleConfig(loggingACL.Child("modules"), modName, "level")
 
 	// The level is set on a per-logger basis
-	moduleLevel := globalLevel
+	configured = globalLevel
 
 	mls := moduleCfg.ChildAsString("level")
 	if len(mls) > 0 {
 		ml, err := logging.LogLevel(mls)
 		if err == nil {
-			moduleLevel = ml
+			configured = ml
 		} else {
 			logDelayed(logging.ERROR, "Did not understand log level for module "+modName)
 		}
 	}
 
-	logging.SetLevel(moduleLevel, modName)
+	// A backend may ask for more detail from this module than the module
+	// level allows, so the gate in front of all backends has to let those
+	// records through. The backend filters take care of the rest.
+	gate = configured
+	for _, holder := range backends {
+		if holder.Filter == nil || !holder.Filter.Wants(modName) {
+			continue
+		}
+		if bl, ok := moduleLevelIn(holder.Filter.Modules, modName); ok && bl > gate {
+			gate = bl
+		}
+	}
+
+	return configured, gate
+}
+
+// The most verbose level the config lets any module log at, whether from the
+// global level, a module level, or a backend's override for a module.
+// registryMutex must be held.
+func mostVerboseLevel() logging.Level {
+	verbose := globalLevel
+	raise := func(level logging.Level) {
+		if level > verbose {
+			verbose = level
+		}
+	}
+
+	loggingACL.Child("modules").ForEachOrderedChild(func(name string, child *AclNode) {
+		if level, err := logging.LogLevel(child.ChildAsString("level")); err == nil {
+			raise(level)
+		}
+	})
+	for _, holder := range backends {
+		if holder.Filter == nil {
+			continue
+		}
+		for _, level := range holder.Filter.Modules {
+			raise(level)
+		}
+	}
+
+	return verbose
+}
+
+// registryMutex must be held.
+func configureLogger(modName string, logger *logging.Logger) {
+	configured, gate := moduleLevel(modName)
+	dispatcher.setModule(modName, gate, configured)
+}
+
+// Logs a message that has already been formatted at the given level.
+func logAt(lgr *logging.Logger, level logging.Level, msg string) {
+	switch level {
+	case logging.CRITICAL:
+		lgr.Critical(msg)
+	case logging.ERROR:
+		lgr.Error(msg)
+	case logging.WARNING:
+		lgr.Warning(msg)
+	case logging.NOTICE:
+		lgr.Notice(msg)
+	case logging.INFO:
+		lgr.Info(msg)
+	default:
+		lgr.Debug(msg)
+	}
 }
 
 // ColoredLoggingToConsole is a convenience method for simple test apps that would like a reasonable
@@ -338,96 +560,172 @@ func ColoredLoggingToConsole() {
 
 }
 
-func SetLoggingConfig(acl *AclNode) {
-	loggingACL = acl.Child("logging")
+// Sets up all of the backends and module levels from the "logging" child
+// of acl. The new configuration replaces the old one all at once, so this is
+// safe to call while other goroutines are logging or calling Logger().
+//
+// Backends that can't be created are left out and the returned error, which
+// is a LoggingConfigError, says what went wrong with each of them. This is the
+// same as calling SetLoggingConfigWithPolicy with LOGGING_ERRORS_WARN except
+// that nothing is logged about the failures.
+func SetLoggingConfig(acl *AclNode) error {
+	return setLoggingConfig(acl, LOGGING_ERRORS_WARN)
+}
 
-	var err error
+// Like SetLoggingConfig but the policy decides what happens to backends that
+// can't be created. With LOGGING_ERRORS_FAIL none of the new configuration is
+// used if any backend fails, and the backends that were created for it are
+// closed. With LOGGING_ERRORS_STDERR each broken backend is
+// replaced with one that writes to stderr. For both of those and for
+// LOGGING_ERRORS_WARN a warning is logged through the new configuration
+// for every failure.
+func SetLoggingConfigWithPolicy(acl *AclNode, policy LoggingErrorPolicy) error {
+	err := setLoggingConfig(acl, policy)
+	if err != nil {
+		alog.Warning(err.Error())
+	}
+	return err
+}
+
+func setLoggingConfig(acl *AclNode, policy LoggingErrorPolicy) error {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	reg := snapshotRegistry()
+
+	node := acl.Child("logging")
 
 	// A couple of easy global config values
-	glString := loggingACL.ChildAsString("level")
+	glString := node.ChildAsString("level")
 	//fmt.Printf("glString=%v\n", glString)
-	globalLevel, err = logging.LogLevel(glString)
+	level, err := logging.LogLevel(glString)
 	if err != nil {
 		//fmt.Printf("err=%v\n", err)
-		globalLevel = logging.INFO
+		level = logging.INFO
 	}
 	//fmt.Printf("globalLevel = %v\n", globalLevel)
-	logDelayed(logging.INFO, "Setting global logging level to "+globalLevel.String())
 
-	fmtStr := loggingACL.ChildAsString("format")
+	// The new backends are all built before anything is changed so that a
+	// failure can leave the old configuration in place
+	built := make(map[string]*BackendHolder)
+	all := make([]logging.Backend, 0)
+	forTesting := false
+	var problems LoggingConfigError
+
+	formatter, _ := NewFormatter(DEFAULT_FIELDS_FORMAT_STRING)
+	fmtStr := node.ChildAsString("format")
 	if len(fmtStr) > 0 {
-		logging.SetFormatter(logging.MustStringFormatter(fmtStr))
-	} else {
-		logging.SetFormatter(logging.MustStringFormatter(DEFAULT_FORMAT_STRING))
+		f, err := NewFormatter(fmtStr)
+		if err == nil {
+			formatter = f
+		} else {
+			problems = append(problems, &BackendError{
+				Path: "logging format",
+				Err:  err,
+			})
+		}
 	}
-
-	// Remove any old backends. When we set a new backend to each logger it
-	// replaces any previous ones that existed there
-	backends = make(map[string]*BackendHolder)
-	all := make([]logging.Backend, 0)
-	beACL := loggingACL.Child("backends")
+	beACL := node.Child("backends")
 	if beACL == nil {
 		be := logging.NewLogBackend(os.Stdout, "", 0)
 		be.Color = true
-		all = append(all, be)
-	} else {
+		all = append(all, logging.NewBackendFormatter(be, formatter))
+	}
 
-		for name, beNode := range beACL.Children {
-			holder := &BackendHolder{
-				Name: name,
-				Node: beNode,
+	addBackend := func(name string, beNode *AclNode) {
+		holder, err := makeBackend(reg, name, beNode, formatter)
+		if err != nil {
+			be, ok := err.(*BackendError)
+			if !ok {
+				be = &BackendError{
+					Name: name,
+					Path: "logging backends " + name,
+					Err:  err,
+				}
 			}
-			kind := beNode.ChildAsString("type")
-			switch kind {
-			case "memory":
-				makeMemoryBackend(holder)
-
-			case "channelMemory":
-				makeChannelMemoryBackend(holder)
-
-			case "stdout":
-				makeStdoutBackend(holder)
-
-			case "stderr":
-				makeStderrBackend(holder)
-
-			case "file":
-				makeFileBackend(holder)
+			problems = append(problems, be)
+			if policy != LOGGING_ERRORS_STDERR {
+				return
+			}
+			holder = fallbackBackend(name, beNode)
+		}
 
-			case "syslog":
-				makeSyslogBackend(holder)
+		// logging.InitForTesting is only called once the new config is
+		// being used, since it replaces the go-logging backend
+		forTesting = forTesting || (beNode.ChildAsString("type") == "memory" && beNode.ChildAsBool("forTesting"))
+
+		built[holder.Name] = holder
+		out := holder.Output()
+		if holder.Filter == nil {
+			// Another backend's module override can raise the gate in front
+			// of every backend, so this one still has to hold records to the
+			// configured module level itself
+			out = &FilterBackend{Backend: out}
+		}
+		all = append(all, logging.NewBackendFormatter(out, formatter))
+	}
 
-			case "loggly":
-				makeLogglyBackend(holder)
+	beACL.ForEachOrderedChild(addBackend)
 
-			case "delayed":
-				makeDelayedBackend(holder)
-			}
+	// Extra backends get all the defaults if they aren't in the config
+	for _, name := range reg.unconfiguredExtras(beACL) {
+		addBackend(name, NewAclNode())
+	}
 
-			if holder.Backend == nil {
-				fmt.Printf("Ignoring backend named '%s' type '%v' because we didn't understand the type\n%v\n", holder.Name, kind, beNode.String())
-				continue
+	if len(problems) > 0 && policy == LOGGING_ERRORS_FAIL {
+		// Nothing global has been touched yet, so all there is to do is
+		// let go of what was built
+		for _, holder := range built {
+			if reg.extras[holder.Name] != holder.Backend {
+				closeBackend(holder.Backend)
 			}
-
-			setupFormatter(holder)
-			backends[holder.Name] = holder
-			all = append(all, holder.Formatted)
 		}
+		return problems
 	}
 
-	if len(all) > 0 {
-		logging.SetBackend(all...)
-	} else {
+	registryMutex.Lock()
+	if forTesting {
+		// This gives records a fixed time, but it also resets go-logging,
+		// so the dispatcher has to be put back afterwards
+		logging.InitForTesting(logging.DEBUG)
+		logging.SetBackend(dispatcher)
+	}
+
+	loggingRoot = acl
+	loggingACL = node
+	globalLevel = level
+	globalFormatter = formatter
+	logging.SetFormatter(globalFormatter)
+	replaced := backends
+	backends = built
+	wakeReplaced(replaced)
+	closeOld := closeReplaced(replaced, built)
+	logDelayed(logging.INFO, "Setting global logging level to "+globalLevel.String())
+
+	if len(all) == 0 {
 		logDelayed(logging.ERROR, "No backends were configured. Default logging configuration!")
+		all = nil
 	}
 
-	// Now that all the backends are there, add them to the proper things
-	for name, logger := range loggers {
-		configureLogger(name, logger)
+	// Now that all the backends are there work out the levels for every
+	// module and hand it all to the dispatcher in one go
+	gates := make(map[string]logging.Level)
+	configured := make(map[string]logging.Level)
+	for name := range loggers {
+		configured[name], gates[name] = moduleLevel(name)
 	}
+	dispatcher.swap(all, gates, configured, mostVerboseLevel())
 
-	// And then some debugging of the config if necessary
 	lcd := loggingACL.ChildAsBool("debug")
+	registryMutex.Unlock()
+
+	// Nothing can reach the old backends once the dispatcher has the new
+	// ones, so files, connections and goroutines they have can go
+	closeOld()
+
+	configureStdLog(node)
+
+	// And then some debugging of the config if necessary
 	if lcd {
 		lgr := logging.MustGetLogger("log-debug")
 
@@ -438,85 +736,290 @@ func SetLoggingConfig(acl *AclNode) {
 		lgr.Info("Informational. That is all")
 		lgr.Debug("WTF hasn't this been debugged yet?")
 	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// Creates a backend and everything that wraps it from its config node. Extra
+// backends are used as they are and the rest come from the factory for their
+// type.
+func makeBackend(reg *backendRegistry, name string, beNode *AclNode, formatter logging.Formatter) (*BackendHolder, error) {
+	holder := &BackendHolder{
+		Name:    name,
+		Node:    beNode,
+		Backend: reg.extras[name],
+	}
+
+	var err error
+	if holder.Backend == nil {
+		kind := beNode.ChildAsString("type")
+		if len(kind) == 0 {
+			return nil, fmt.Errorf("No type given")
+		}
+
+		factory := reg.types[kind]
+		if factory == nil {
+			return nil, fmt.Errorf("Unknown backend type '%s'", kind)
+		}
+
+		holder.Backend, err = factory(beNode)
+		if err != nil {
+			return nil, err
+		}
+		if holder.Backend == nil {
+			return nil, fmt.Errorf("The factory for type '%s' didn't create a backend", kind)
+		}
+	}
+
+	err = setupFormatter(holder)
+	if err != nil {
+		return nil, &BackendError{
+			Name: name,
+			Path: "logging backends " + name + " format",
+			Err:  err,
+		}
+	}
+	holder.Limit = NewLimitBackend(holder.Formatted, beNode)
+	if holder.Limit != nil {
+		holder.Limit.Formatter = formatter
+	}
+	holder.Filter, err = NewFilterBackend(holder.limited(), beNode)
+	if err != nil {
+		return nil, err
+	}
+
+	return holder, nil
 }
 
-func setupFormatter(holder *BackendHolder) {
+// Used in place of a backend that couldn't be created when the policy is
+// LOGGING_ERRORS_STDERR.
+func fallbackBackend(name string, beNode *AclNode) *BackendHolder {
+	be := logging.NewLogBackend(os.Stderr, "", 0)
+
+	return &BackendHolder{
+		Name:      name,
+		Node:      beNode,
+		Backend:   be,
+		Formatted: be,
+	}
+}
+
+func setupFormatter(holder *BackendHolder) error {
+
+	be := holder.Backend
+	switch be.(type) {
+	case *logging.MemoryBackend, *logging.ChannelMemoryBackend:
+		// The go-logging memory backend isn't safe for concurrent writers
+		// and records in either one might be formatted long after the fact
+		holder.locked = &lockedBackend{Backend: be}
+		be = holder.locked
+	}
 
 	fmtStr := holder.Node.ChildAsString("format")
 	if len(fmtStr) == 0 {
 		// fmt.Printf("Using default formatter for %v\n", holder)
-		holder.Formatted = holder.Backend
-		return
+		holder.Formatted = be
+		return nil
 	}
 
 	// fmt.Printf("Using custom formatter '%v' for %v\n", fmtStr, holder)
-	formatter := logging.MustStringFormatter(fmtStr)
-	holder.Formatted = logging.NewBackendFormatter(holder.Backend, formatter)
+	formatter, err := NewFormatter(fmtStr)
+	if err != nil {
+		return err
+	}
+	holder.Formatted = logging.NewBackendFormatter(be, formatter)
+	return nil
 }
 
-func makeMemoryBackend(holder *BackendHolder) {
+// Serializes calls to Log for backends that can't handle concurrent calls.
+// Records are formatted before they are passed on so that anything about the
+// caller in the format is still right when they are read later.
+type lockedBackend struct {
+	Backend logging.Backend
+	mutex   sync.Mutex
 
-	level, err := logging.LogLevel(holder.Node.ChildAsString("level"))
-	if err != nil {
-		level = globalLevel
+	// Closed when something changes, see changed. It's only made once
+	// someone is waiting so logging doesn't pay for it otherwise.
+	notify chan struct{}
+
+	// The last records logged, so that a stream following along only has to
+	// look at the ones it hasn't seen. seq counts every record logged and
+	// the one numbered n is at recent[n % LOCKED_RECENT_RECORDS].
+	recent []*logging.Record
+	seq    uint64
+}
+
+// How many of the latest records a memory backend keeps aside for streams
+const LOCKED_RECENT_RECORDS = 256
+
+func (l *lockedBackend) Log(level logging.Level, depth int, r *logging.Record) error {
+	r.Formatted(depth + 1)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	err := l.Backend.Log(level, depth+1, r)
+	if len(l.recent) < LOCKED_RECENT_RECORDS {
+		l.recent = append(l.recent, r)
+	} else {
+		l.recent[l.seq%LOCKED_RECENT_RECORDS] = r
+	}
+	l.seq++
+	l.wakeLocked()
+	return err
+}
+
+// Returns a channel that is closed the next time a record is logged or the
+// backend is replaced by a new logging config.
+func (l *lockedBackend) changed() <-chan struct{} {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.notify == nil {
+		l.notify = make(chan struct{})
+	}
+	return l.notify
+}
+
+func (l *lockedBackend) wake() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.wakeLocked()
+}
+
+// l.mutex must be held.
+func (l *lockedBackend) wakeLocked() {
+	if l.notify != nil {
+		close(l.notify)
+		l.notify = nil
+	}
+}
+
+// Works out what to close once the backends in replaced have been swapped
+// for the ones in current. Extra backends and any backend that's still in
+// current are kept, though the limits around them are stopped if they
+// belonged to the old config, and so is everything in a state from
+// SaveLogging that hasn't been restored. registryMutex must be held, but the returned
+// function should be called once it's released since closing can block.
+func closeReplaced(replaced, current map[string]*BackendHolder) func() {
+	var limits []*LimitBackend
+	var closing []logging.Backend
+	for name, holder := range replaced {
+		kept := current[name]
+		if kept == holder || isSaved(holder) {
+			continue
+		}
+		if holder.Limit != nil {
+			limits = append(limits, holder.Limit)
+		}
+		if (kept != nil && kept.Backend == holder.Backend) || extraBackends[name] == holder.Backend {
+			continue
+		}
+		closing = append(closing, holder.Backend)
+	}
+
+	return func() {
+		// Any counts the limits still have are sent before the backends
+		// under them are closed
+		for _, l := range limits {
+			l.Close()
+		}
+		for _, be := range closing {
+			closeBackend(be)
+		}
+	}
+}
+
+// Lets anything waiting on the memory backends that are being replaced know
+// to look them up again
+func wakeReplaced(replaced map[string]*BackendHolder) {
+	for _, holder := range replaced {
+		if holder.locked != nil {
+			holder.locked.wake()
+		}
 	}
+}
 
-	size := holder.Node.ChildAsInt("size")
+func makeMemoryBackend(node *AclNode) (logging.Backend, error) {
+
+	size := node.ChildAsInt("size")
 	if size == 0 {
 		size = 3000
 	}
 
-	if holder.Node.ChildAsBool("forTesting") {
-		holder.Backend = logging.InitForTesting(level)
-	} else {
-		holder.Backend = logging.NewMemoryBackend(size)
+	// The same size logging.InitForTesting uses, which setLoggingConfig
+	// calls once the config is in use
+	if node.ChildAsBool("forTesting") {
+		size = 10240
+	}
+	return logging.NewMemoryBackend(size), nil
+}
+
+// Closes whatever a backend that won't be used has open. Backends that don't
+// have anything to close are left alone.
+func closeBackend(be logging.Backend) {
+	switch b := be.(type) {
+	case *logging.LogBackend:
+		w := b.Logger.Writer()
+		if c, ok := w.(io.Closer); ok && w != os.Stdout && w != os.Stderr {
+			c.Close()
+		}
+	case *logging.SyslogBackend:
+		b.Writer.Close()
+	case interface{ Close() error }:
+		b.Close()
+	case interface{ Close() }:
+		b.Close()
 	}
 }
 
-func makeChannelMemoryBackend(holder *BackendHolder) {
+func makeChannelMemoryBackend(node *AclNode) (logging.Backend, error) {
 
-	size := holder.Node.ChildAsInt("size")
+	size := node.ChildAsInt("size")
 	if size == 0 {
 		size = 3000
 	}
 
-	holder.Backend = logging.NewChannelMemoryBackend(size)
+	return logging.NewChannelMemoryBackend(size), nil
 }
 
-func makeStdoutBackend(holder *BackendHolder) {
+func makeStdoutBackend(node *AclNode) (logging.Backend, error) {
 
 	be := logging.NewLogBackend(os.Stdout, "", 0)
-	be.Color = holder.Node.ChildAsBool("color")
+	be.Color = node.ChildAsBool("color")
 
-	holder.Backend = be
+	return be, nil
 }
 
-func makeStderrBackend(holder *BackendHolder) {
+func makeStderrBackend(node *AclNode) (logging.Backend, error) {
 
 	be := logging.NewLogBackend(os.Stderr, "", 0)
-	be.Color = holder.Node.ChildAsBool("color")
+	be.Color = node.ChildAsBool("color")
 
-	holder.Backend = be
+	return be, nil
 }
 
-func makeFileBackend(holder *BackendHolder) {
+func makeFileBackend(node *AclNode) (logging.Backend, error) {
 
-	fName := holder.Node.ChildAsString("filename")
+	fName := node.ChildAsString("filename")
 	if len(fName) == 0 {
-		return
+		return nil, fmt.Errorf("No filename for file backend")
 	}
 
 	// TODO: More exciting things about filename such as sequence numbers, etc.
 
 	file, err := os.OpenFile(fName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, os.FileMode(0666))
 	if err != nil {
-		log.Panicf("Unable to open file '%s' : %s", fName, err)
-		return
+		return nil, fmt.Errorf("Unable to open file '%s' : %s", fName, err)
 	}
 
 	be := logging.NewLogBackend(file, "", 0)
-	be.Color = holder.Node.ChildAsBool("color")
-	holder.Backend = be
+	be.Color = node.ChildAsBool("color")
+	return be, nil
 }
 
 var SyslogFacilities = map[string]syslog.Priority{
@@ -543,90 +1046,43 @@ var SyslogFacilities = map[string]syslog.Priority{
 	"local7": syslog.LOG_LOCAL7,
 }
 
-func makeSyslogBackend(holder *BackendHolder) {
-	var err error
+func makeSyslogBackend(node *AclNode) (logging.Backend, error) {
 
-	prefix := holder.Node.ChildAsString("prefix")
-	fac := holder.Node.ChildAsString("facility")
+	prefix := node.ChildAsString("prefix")
+	fac := node.ChildAsString("facility")
 
 	var facility syslog.Priority
 	if len(fac) > 0 {
-		facility = SyslogFacilities[fac]
+		var ok bool
+		facility, ok = SyslogFacilities[fac]
+		if !ok {
+			return nil, fmt.Errorf("Unknown syslog facility '%s'", fac)
+		}
 	}
 
+	var be logging.Backend
+	var err error
 	if facility > 0 {
-		holder.Backend, err = logging.NewSyslogBackendPriority(prefix, facility)
+		be, err = logging.NewSyslogBackendPriority(prefix, facility)
 	} else {
-		holder.Backend, err = logging.NewSyslogBackend(prefix)
+		be, err = logging.NewSyslogBackend(prefix)
 	}
 
 	if err != nil {
-		log.Panicf("Unable to create syslog backend: %s", err)
+		return nil, fmt.Errorf("Unable to create syslog backend: %s", err)
 	}
+	return be, nil
 }
 
-func makeLogglyBackend(holder *BackendHolder) {
+func makeLogglyBackend(node *AclNode) (logging.Backend, error) {
 
-	token := holder.Node.ChildAsString("token")
+	token := node.ChildAsString("token")
 	if len(token) == 0 {
-		log.Panicf("No token for loggly backend")
+		return nil, fmt.Errorf("No token for loggly backend")
 	}
 
-	tags := holder.Node.ChildAsStringList("tags")
+	tags := node.ChildAsStringList("tags")
 
 	client := NewLogglyClient(token, tags...)
-	holder.Backend = client
+	return client, nil
 }
-
-func makeDelayedBackend(holder *BackendHolder) {
-	maxCache := holder.Node.DefChildAsInt(-1,"maxCache")
-
-	holder.Backend = NewDelayedBacked(maxCache)
-}
-
-
-type DelayedBackend struct {
-	realBackend logging.Backend
-	MaxCache    int
-	cache       []*logging.Record
-}
-
-func NewDelayedBacked(maxCache int) *DelayedBackend {
-	d := &DelayedBackend{
-		MaxCache: maxCache,
-	}
-
-	return d
-}
-
-func (d *DelayedBackend) SetRealBackend(be logging.Backend) {
-	if be == nil {
-		d.realBackend = nil
-		return
-	}
-
-	d.realBackend = be
-	for _, r := range(d.cache) {
-		_ = d.realBackend.Log(r.Level, 0, r)
-	}
-	d.cache = d.cache[:0]
-}
-
-func (d DelayedBackend) Log(level logging.Level, depth int, r *logging.Record) error {
-	if d.realBackend != nil {
-		return d.realBackend.Log(level, depth, r)
-	}
-
-	if d.MaxCache == 0 {
-		return nil
-	}
-
-	if d.MaxCache > 0 && len(d.cache) == d.MaxCache {
-		d.cache = d.cache[len(d.cache) - 1 - d.MaxCache:]
-	}
-
-	d.cache = append(d.cache, r)
-
-	return nil
-}
-
@@ -0,0 +1,305 @@
+package archercl
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/op/go-logging"
+)
+
+// Returns the configured level of every module that has been registered
+// through Logger(), keyed by module name.
+func ModuleLevels() map[string]logging.Level {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	out := make(map[string]logging.Level)
+	for name := range loggers {
+		level, ok := configuredLevel(name)
+		if !ok {
+			level = globalLevel
+		}
+		out[name] = level
+	}
+
+	return out
+}
+
+// Returns the config that was last given to SetLoggingConfig, or nil if it
+// hasn't been called. This is the whole config, not just the logging node.
+func LoggingConfig() *AclNode {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	return loggingRoot
+}
+
+// The logging setup at one point in time, see SaveLogging
+type LoggingState struct {
+	root      *AclNode
+	node      *AclNode
+	level     logging.Level
+	formatter logging.Formatter
+	backends  map[string]*BackendHolder
+	outputs   []logging.Backend
+}
+
+// The states from SaveLogging that haven't been restored yet, whose backends
+// mustn't be closed when a new config replaces them. registryMutex must be
+// held.
+var savedStates = make(map[*LoggingState]bool)
+
+// registryMutex must be held.
+func isSaved(holder *BackendHolder) bool {
+	for state := range savedStates {
+		if state.backends[holder.Name] == holder {
+			return true
+		}
+	}
+	return false
+}
+
+// Remembers the current logging setup, including the backends themselves,
+// so that RestoreLogging can put it back. This is different from giving
+// LoggingConfig() to SetLoggingConfig later, which builds new backends. The
+// saved backends are left open when they are replaced until the state is
+// restored.
+func SaveLogging() *LoggingState {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	dispatcher.mutex.RLock()
+	outputs := dispatcher.outputs
+	dispatcher.mutex.RUnlock()
+
+	state := &LoggingState{
+		root:      loggingRoot,
+		node:      loggingACL,
+		level:     globalLevel,
+		formatter: globalFormatter,
+		backends:  backends,
+		outputs:   outputs,
+	}
+	savedStates[state] = true
+	return state
+}
+
+// Goes back to a setup from SaveLogging using the same backend instances,
+// so anything they had open or running carries on where it was. Backends
+// from the setup being replaced that aren't part of the saved one, and
+// aren't extra backends, are closed. Module levels are worked out again
+// from the saved config, including for loggers created since it was saved.
+func RestoreLogging(state *LoggingState) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	registryMutex.Lock()
+
+	delete(savedStates, state)
+	replaced := backends
+	loggingRoot = state.root
+	loggingACL = state.node
+	globalLevel = state.level
+	globalFormatter = state.formatter
+	backends = state.backends
+	if globalFormatter != nil {
+		logging.SetFormatter(globalFormatter)
+	}
+
+	gates := make(map[string]logging.Level)
+	configured := make(map[string]logging.Level)
+	for name := range loggers {
+		configured[name], gates[name] = moduleLevel(name)
+	}
+	dispatcher.swap(state.outputs, gates, configured, mostVerboseLevel())
+
+	wakeReplaced(replaced)
+	closeOld := closeReplaced(replaced, backends)
+
+	node := loggingACL
+	registryMutex.Unlock()
+
+	closeOld()
+
+	configureStdLog(node)
+}
+
+// Returns the global logging level
+func GlobalLevel() logging.Level {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	return globalLevel
+}
+
+// Changes the level of a single module while the program is running. The
+// change is also written into the logging config node so that it is seen by
+// a later call to SetLoggingConfig or in a dump of the config.
+func SetModuleLevel(modName string, level logging.Level) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	node := writableLoggingACL()
+	node.SetValAt(strings.ToLower(level.String()), "modules", modName, "level")
+
+	// Modules below this one may get their level from it
+	for name, logger := range loggers {
+		configureLogger(name, logger)
+	}
+	if loggers[modName] == nil {
+		dispatcher.SetLevel(level, modName)
+	}
+}
+
+// Changes the global logging level while the program is running. Modules
+// that have their own level are not affected. As with SetModuleLevel the
+// change is written back into the logging config node.
+func SetGlobalLevel(level logging.Level) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	setGlobalLevel(level)
+}
+
+// registryMutex must be held.
+func setGlobalLevel(level logging.Level) {
+	node := writableLoggingACL()
+	node.SetValAt(strings.ToLower(level.String()), "level")
+
+	globalLevel = level
+	for name, logger := range loggers {
+		configureLogger(name, logger)
+	}
+}
+
+// Moves the global level by delta steps, where a positive delta is more
+// verbose, stopping at DEBUG and CRITICAL.
+func StepGlobalLevel(delta int) logging.Level {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	level := globalLevel + logging.Level(delta)
+	if level > logging.DEBUG {
+		level = logging.DEBUG
+	}
+	if level < logging.CRITICAL {
+		level = logging.CRITICAL
+	}
+
+	setGlobalLevel(level)
+	return level
+}
+
+// The logging node, which is created if the config didn't have one.
+// registryMutex must be held.
+func writableLoggingACL() *AclNode {
+	if loggingACL != nil {
+		return loggingACL
+	}
+
+	if loggingRoot == nil {
+		loggingRoot = NewAclNode()
+	}
+	loggingACL, _ = loggingRoot.createChild("logging")
+	return loggingACL
+}
+
+type levelState struct {
+	Global  string            `json:"global"`
+	Modules map[string]string `json:"modules"`
+}
+
+type levelChange struct {
+	Module string `json:"module"`
+	Level  string `json:"level"`
+}
+
+type logLevelHandler struct{}
+
+// Returns an http.Handler for looking at and changing log levels at runtime.
+//
+// A GET returns the global level and the level of every module registered
+// through Logger() as JSON
+//
+//	{"global":"INFO","modules":{"db":"WARNING","web":"DEBUG"}}
+//
+// or just one module with GET /loglevels?module=web
+//
+//	{"module":"web","level":"DEBUG"}
+//
+// A PUT or POST changes a level. The module and level can be given as query
+// parameters, as in PUT /loglevels?module=web&level=debug, or as a JSON body
+// like {"module":"web","level":"debug"}. Leaving out the module changes the
+// global level. The response is the same as for a GET.
+//
+// There is no authentication here so be careful about where it is mounted.
+func LogLevelHandler() http.Handler {
+	return logLevelHandler{}
+}
+
+func (h logLevelHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		modName := req.URL.Query().Get("module")
+		if len(modName) > 0 {
+			level, ok := ModuleLevels()[modName]
+			if !ok {
+				http.Error(w, "No module named '"+modName+"'", http.StatusNotFound)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(levelChange{Module: modName, Level: level.String()})
+			return
+		}
+
+	case http.MethodPut, http.MethodPost:
+		change := levelChange{
+			Module: req.URL.Query().Get("module"),
+			Level:  req.URL.Query().Get("level"),
+		}
+
+		if len(change.Level) == 0 {
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = json.Unmarshal(body, &change)
+			if err != nil {
+				http.Error(w, "Could not parse the request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		level, err := logging.LogLevel(change.Level)
+		if err != nil {
+			http.Error(w, "Unknown log level '"+change.Level+"'", http.StatusBadRequest)
+			return
+		}
+
+		if len(change.Module) == 0 {
+			SetGlobalLevel(level)
+		} else {
+			SetModuleLevel(change.Module, level)
+		}
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	state := levelState{
+		Global:  GlobalLevel().String(),
+		Modules: make(map[string]string),
+	}
+	for name, level := range ModuleLevels() {
+		state.Modules[name] = level.String()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
@@ -0,0 +1,161 @@
+package archercl
+
+import (
+	"log"
+	"os"
+	"sync"
+
+	"github.com/op/go-logging"
+)
+
+// The dispatchBackend is installed as the go-logging default backend exactly
+// once, and every reconfiguration swaps what is inside of it instead of
+// calling logging.SetBackend again. This is what makes it safe to log from
+// any number of goroutines while SetLoggingConfig is being called, since
+// neither the default backend variable nor the module level map inside of
+// go-logging are protected by any locks.
+type dispatchBackend struct {
+	mutex sync.RWMutex
+
+	// Each output is already wrapped with the global formatter
+	outputs []logging.Backend
+
+	// The level records must be at or above to get to any output at all,
+	// which takes per-backend module overrides into account.
+	gates map[string]logging.Level
+
+	// The level each module was configured for before per-backend overrides
+	configured map[string]logging.Level
+
+	// Used for modules that aren't in gates
+	defaultGate logging.Level
+
+	// At least as verbose as any gate could be, including ones for modules
+	// that don't have a logger yet
+	verbose logging.Level
+}
+
+var dispatcher = newDispatchBackend()
+
+func init() {
+	logging.SetBackend(dispatcher)
+}
+
+// Starts out the same as go-logging does by default, which is everything
+// going to stderr.
+func newDispatchBackend() *dispatchBackend {
+	be := logging.NewLogBackend(os.Stderr, "", log.LstdFlags)
+
+	return &dispatchBackend{
+		outputs:     []logging.Backend{logging.NewBackendFormatter(be, logging.DefaultFormatter)},
+		gates:       make(map[string]logging.Level),
+		configured:  make(map[string]logging.Level),
+		defaultGate: logging.DEBUG,
+		verbose:     logging.DEBUG,
+	}
+}
+
+// Replaces the outputs and levels all at once. Any record being logged at the
+// same time sees either the old or the new configuration, never a mix.
+func (d *dispatchBackend) swap(outputs []logging.Backend, gates, configured map[string]logging.Level, verbose logging.Level) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if outputs != nil {
+		d.outputs = outputs
+	}
+	d.gates = gates
+	d.configured = configured
+	d.verbose = verbose
+	for _, gate := range gates {
+		d.raiseVerbose(gate)
+	}
+}
+
+// d.mutex must be held for writing.
+func (d *dispatchBackend) raiseVerbose(level logging.Level) {
+	if level > d.verbose {
+		d.verbose = level
+	}
+}
+
+// The most verbose level that any module might let through, for callers
+// that need to decide before they know the module.
+func (d *dispatchBackend) mostVerbose() logging.Level {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if d.defaultGate > d.verbose {
+		return d.defaultGate
+	}
+	return d.verbose
+}
+
+// Sets both levels for one module.
+func (d *dispatchBackend) setModule(modName string, gate, configured logging.Level) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.gates[modName] = gate
+	d.configured[modName] = configured
+	d.raiseVerbose(gate)
+}
+
+func (d *dispatchBackend) configuredLevel(modName string) (logging.Level, bool) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	level, ok := d.configured[modName]
+	return level, ok
+}
+
+func (d *dispatchBackend) GetLevel(modName string) logging.Level {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	level, ok := d.gates[modName]
+	if !ok {
+		level = d.defaultGate
+	}
+	return level
+}
+
+func (d *dispatchBackend) SetLevel(level logging.Level, modName string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if len(modName) == 0 {
+		d.defaultGate = level
+		return
+	}
+	d.gates[modName] = level
+	d.raiseVerbose(level)
+}
+
+func (d *dispatchBackend) IsEnabledFor(level logging.Level, modName string) bool {
+	return level <= d.GetLevel(modName)
+}
+
+func (d *dispatchBackend) Log(level logging.Level, depth int, r *logging.Record) (err error) {
+	d.mutex.RLock()
+	outputs := d.outputs
+	gate, ok := d.gates[r.Module]
+	if !ok {
+		gate = d.defaultGate
+	}
+	d.mutex.RUnlock()
+
+	if level > gate {
+		return nil
+	}
+
+	for _, out := range outputs {
+		// Each output gets its own copy since the formatted text is cached
+		// in the record
+		r2 := *r
+		if e := out.Log(level, depth+1, &r2); e != nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package archercl
+
+import (
+	"strings"
+)
+
+// What Load does when some of the configured logging backends can't be
+// created, for instance because a log file can't be opened.
+type LoggingErrorPolicy int
+
+const (
+	// Log a warning about each backend that couldn't be created and carry on
+	// with the ones that could. This is the default.
+	LOGGING_ERRORS_WARN LoggingErrorPolicy = iota
+
+	// Leave the logging configuration alone and return the error from Load
+	LOGGING_ERRORS_FAIL
+
+	// Send whatever would have gone to a broken backend to stderr instead, so
+	// nothing is lost, and log a warning about it
+	LOGGING_ERRORS_STDERR
+)
+
+// The reason a single backend couldn't be created, or something else in the
+// logging config, such as the global format, couldn't be used.
+type BackendError struct {
+	// The name of the backend, which is empty for problems that aren't with
+	// a backend
+	Name string
+
+	// Where the problem is in the config, such as "logging backends file" or
+	// "logging backends console format"
+	Path string
+
+	Err error
+}
+
+func (e *BackendError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+// Returned by SetLoggingConfig when there were problems with the logging
+// config. There is one entry for each problem.
+type LoggingConfigError []*BackendError
+
+func (e LoggingConfigError) Error() string {
+	if len(e) == 1 {
+		return "Problem with the logging config at " + e[0].Error()
+	}
+
+	lines := make([]string, 0, len(e)+1)
+	lines = append(lines, "Problems with the logging config:")
+	for _, be := range e {
+		lines = append(lines, "    "+be.Error())
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,116 @@
+package archercl
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/op/go-logging"
+)
+
+// One structured value attached to log records by ModuleLogger.With
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// The structured values attached to a record. A ModuleLogger passes them
+// along as the last argument of the record in a way that doesn't change the
+// message, which is how they get from the logger to the backends.
+type Fields []Field
+
+// Fields are carried as a record argument, so they print as nothing when the
+// message is formatted.
+func (f Fields) Format(s fmt.State, verb rune) {}
+
+// Returns the fields as space separated key=value pairs, quoting any values
+// that need it.
+func (f Fields) String() string {
+	var sb strings.Builder
+	for ix, field := range f {
+		if ix > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(field.Key)
+		sb.WriteByte('=')
+
+		val := fmt.Sprint(field.Value)
+		if len(val) == 0 || strings.ContainsAny(val, " =\"\t\n") {
+			val = strconv.Quote(val)
+		}
+		sb.WriteString(val)
+	}
+	return sb.String()
+}
+
+// Returns a copy with more fields added from alternating keys and values.
+// Keys that are already there have their value replaced. A value without a
+// key gets the key "!BADKEY" the same as log/slog does.
+func (f Fields) With(keyvals ...interface{}) Fields {
+	out := make(Fields, len(f), len(f)+len(keyvals)/2)
+	copy(out, f)
+
+	for len(keyvals) > 0 {
+		var field Field
+		key, ok := keyvals[0].(string)
+		if !ok || len(keyvals) == 1 {
+			field = Field{Key: "!BADKEY", Value: keyvals[0]}
+			keyvals = keyvals[1:]
+		} else {
+			field = Field{Key: key, Value: keyvals[1]}
+			keyvals = keyvals[2:]
+		}
+
+		replaced := false
+		for ix := range out {
+			if out[ix].Key == field.Key {
+				out[ix] = field
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			out = append(out, field)
+		}
+	}
+
+	return out
+}
+
+// Finds the fields of a record, if it has any.
+func RecordFields(r *logging.Record) Fields {
+	if len(r.Args) == 0 {
+		return nil
+	}
+
+	fields, _ := r.Args[len(r.Args)-1].(Fields)
+	return fields
+}
+
+// go-logging doesn't allow new verbs, so %{fields} is swapped for this before
+// the format is given to it and then swapped back for the fields afterwards
+const fieldsPlaceholder = "\x00fields\x00"
+
+// Adds the %{fields} verb to a go-logging formatter.
+type fieldsFormatter struct {
+	formatter logging.Formatter
+}
+
+func (f *fieldsFormatter) Format(calldepth int, r *logging.Record, w io.Writer) error {
+	var buf bytes.Buffer
+	err := f.formatter.Format(calldepth+1, r, &buf)
+	if err != nil {
+		return err
+	}
+
+	text := ""
+	fields := RecordFields(r)
+	if len(fields) > 0 {
+		text = " " + fields.String()
+	}
+
+	_, err = io.WriteString(w, strings.Replace(buf.String(), fieldsPlaceholder, text, -1))
+	return err
+}
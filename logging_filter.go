@@ -0,0 +1,142 @@
+package archercl
+
+import (
+	"fmt"
+
+	"github.com/op/go-logging"
+)
+
+// A FilterBackend sits in front of a configured backend and drops records that
+// the backend has not asked for. This is what allows one backend, such as
+// syslog, to only receive WARNING and above while a console backend still gets
+// DEBUG messages for a particular module.
+//
+// The rules come from the backend's own configuration block
+//
+//	syslog {
+//		type: syslog
+//		level: warning
+//
+//		modules {
+//			include: [ web db ]
+//			exclude: [ noisy ]
+//
+//			// Per-module overrides for just this backend
+//			web level: debug
+//		}
+//	}
+//
+// The level for a backend can only make the output quieter than what the
+// module has been configured for globally. A per-module override inside the
+// backend block always wins, and the module level used to gate records before
+// they ever reach any backend is raised to allow for it. Backends without any
+// rules of their own are put behind an empty FilterBackend so those extra
+// records still stop at the module level for them.
+type FilterBackend struct {
+	// The backend that accepted records are passed on to
+	Backend logging.Backend
+
+	// If HasLevel is true, no records less severe than Level are accepted
+	Level    logging.Level
+	HasLevel bool
+
+	// If Include is non-empty, only records from these modules are accepted.
+	// Records from modules in Exclude are never accepted.
+	Include []string
+	Exclude []string
+
+	// Levels for specific modules that replace everything else
+	Modules map[string]logging.Level
+}
+
+// Creates a FilterBackend from the configuration node of a backend. If the
+// node doesn't have any filtering configuration nil is returned so that the
+// backend can be used without a wrapper. An error is returned if any of the
+// levels can't be understood.
+func NewFilterBackend(be logging.Backend, node *AclNode) (*FilterBackend, error) {
+	f := &FilterBackend{
+		Backend: be,
+		Modules: make(map[string]logging.Level),
+	}
+
+	ls := node.ChildAsString("level")
+	if len(ls) > 0 {
+		level, err := logging.LogLevel(ls)
+		if err == nil {
+			f.Level = level
+			f.HasLevel = true
+		} else {
+			return nil, fmt.Errorf("Unknown log level '%s'", ls)
+		}
+	}
+
+	modules := node.Child("modules")
+	f.Include = modules.ChildAsStringList("include")
+	f.Exclude = modules.ChildAsStringList("exclude")
+
+	var err error
+	modules.ForEachOrderedChild(func(name string, child *AclNode) {
+		if err != nil || name == "include" || name == "exclude" {
+			return
+		}
+
+		mls := child.ChildAsString("level")
+		if len(mls) == 0 {
+			return
+		}
+
+		level, e := logging.LogLevel(mls)
+		if e != nil {
+			err = fmt.Errorf("Unknown log level '%s' for module %s", mls, name)
+			return
+		}
+		f.Modules[name] = level
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !f.HasLevel && len(f.Include) == 0 && len(f.Exclude) == 0 && len(f.Modules) == 0 {
+		return nil, nil
+	}
+
+	return f, nil
+}
+
+// Reports whether records from the module are wanted by this backend at all,
+// regardless of level.
+func (f *FilterBackend) Wants(module string) bool {
+	if moduleInList(f.Exclude, module) {
+		return false
+	}
+
+	return len(f.Include) == 0 || moduleInList(f.Include, module)
+}
+
+// Reports whether a record at the given level from the given module would be
+// passed on to the wrapped backend.
+func (f *FilterBackend) Accepts(level logging.Level, module string) bool {
+	if !f.Wants(module) {
+		return false
+	}
+
+	if ml, ok := moduleLevelIn(f.Modules, module); ok {
+		return level <= ml
+	}
+
+	limit, ok := configuredLevel(module)
+	if f.HasLevel && (!ok || f.Level < limit) {
+		limit = f.Level
+		ok = true
+	}
+
+	return !ok || level <= limit
+}
+
+func (f *FilterBackend) Log(level logging.Level, depth int, r *logging.Record) error {
+	if !f.Accepts(level, r.Module) {
+		return nil
+	}
+
+	return f.Backend.Log(level, depth+1, r)
+}
@@ -0,0 +1,139 @@
+package archercl
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/op/go-logging"
+)
+
+// Formats in the config that start with this are the name of a preset
+// instead of a go-logging format string
+const FORMAT_PRESET_PREFIX = "preset:"
+
+// The named formats that can be used with "format: preset:<name>" so that
+// nobody has to remember the go-logging verbs. The logfmt preset isn't here
+// because it isn't a format string, see LogfmtFormatter.
+var FormatPresets = map[string]string{
+	// Just the basics
+	"compact": "%{time:15:04:05} %{level:.4s} %{module} %{message}%{fields}",
+
+	// Colored for a terminal, with the function that logged each message
+	"dev-color": "%{color}%{time:15:04:05.000} %{level:4.4s} %{module:8.8s} %{color:bold}%{shortfunc:10.10s}%{color:reset} ▶ %{message}%{fields}",
+
+	// Full timestamps for files and log collectors
+	"iso8601": "%{time:2006-01-02T15:04:05.000Z07:00} %{level} %{module} %{message}%{fields}",
+}
+
+// Creates a formatter for a format from the config, which can be a preset
+// name like "preset:compact" or a go-logging format string. On top of the
+// go-logging verbs this understands %{fields}, which is a space followed by
+// the fields of the record, or nothing if it doesn't have any, so it goes
+// right after %{message}.
+func NewFormatter(format string) (logging.Formatter, error) {
+	if strings.HasPrefix(format, FORMAT_PRESET_PREFIX) {
+		name := strings.TrimSpace(format[len(FORMAT_PRESET_PREFIX):])
+		if name == "logfmt" {
+			return &LogfmtFormatter{}, nil
+		}
+
+		preset, ok := FormatPresets[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown format preset '%s'", name)
+		}
+		format = preset
+	}
+
+	var formatter logging.Formatter
+	var err error
+	if strings.Contains(format, "%{fields}") {
+		formatter, err = logging.NewStringFormatter(strings.Replace(format, "%{fields}", fieldsPlaceholder, -1))
+		if err == nil {
+			formatter = &fieldsFormatter{formatter: formatter}
+		}
+	} else {
+		formatter, err = logging.NewStringFormatter(format)
+	}
+	if err != nil {
+		// go-logging errors are prefixed with "logger: "
+		msg := strings.TrimPrefix(err.Error(), "logger: ")
+		return nil, fmt.Errorf("Invalid format \"%s\": %s", format, msg)
+	}
+
+	return formatter, nil
+}
+
+// Formats records as logfmt, which is a line of key=value pairs that is easy
+// for both people and log collectors to read
+//
+//	time=2006-01-02T15:04:05.000Z level=info module=web caller=server.go:82 msg="Serving /index.html" request=42
+//
+// Any fields on the record come after msg.
+type LogfmtFormatter struct {
+	// Leaves out the caller, which saves looking up the call stack for every record
+	NoCaller bool
+}
+
+func (f *LogfmtFormatter) Format(calldepth int, r *logging.Record, w io.Writer) error {
+	var sb strings.Builder
+
+	sb.WriteString("time=")
+	sb.WriteString(r.Time.Format("2006-01-02T15:04:05.000Z07:00"))
+	sb.WriteString(" level=")
+	sb.WriteString(strings.ToLower(r.Level.String()))
+	writeLogfmtPair(&sb, "module", r.Module)
+
+	if !f.NoCaller {
+		if _, file, line, ok := runtime.Caller(calldepth + 1); ok {
+			writeLogfmtPair(&sb, "caller", filepath.Base(file)+":"+strconv.Itoa(line))
+		}
+	}
+
+	writeLogfmtPair(&sb, "msg", r.Message())
+	for _, field := range RecordFields(r) {
+		writeLogfmtPair(&sb, field.Key, fmt.Sprint(field.Value))
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// Adds " key=value" quoting the value if it needs it. Keys can't be quoted so
+// anything that would break them up is replaced with an underscore.
+func writeLogfmtPair(sb *strings.Builder, key, value string) {
+	sb.WriteByte(' ')
+	if len(key) == 0 {
+		key = "_"
+	}
+	for _, c := range key {
+		if c <= ' ' || c == '=' || c == '"' || c == unicode.ReplacementChar {
+			sb.WriteByte('_')
+		} else {
+			sb.WriteRune(c)
+		}
+	}
+	sb.WriteByte('=')
+
+	if logfmtNeedsQuotes(value) {
+		sb.WriteString(strconv.Quote(value))
+	} else {
+		sb.WriteString(value)
+	}
+}
+
+func logfmtNeedsQuotes(value string) bool {
+	if len(value) == 0 {
+		return true
+	}
+	for _, c := range value {
+		if c <= ' ' || c == '=' || c == '"' || c == '\\' || !unicode.IsPrint(c) {
+			return true
+		}
+	}
+	return false
+}
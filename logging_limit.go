@@ -0,0 +1,301 @@
+package archercl
+
+import (
+	"math"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// A LimitBackend protects a backend from hot loops that produce the same log
+// line thousands of times a second. Records are grouped by their module, level
+// and format string, such as "Retrying %s", so each distinct message is
+// limited on its own whatever its arguments are and wherever it's logged from.
+// Every SummaryInterval a record saying how many messages were suppressed is
+// sent for each format that had some. Formats that haven't logged anything
+// for a while are forgotten.
+//
+// Sampling lets the First records in each second through and then only every
+// Thereafter'th one after that. Rate limiting is a token bucket which allows
+// PerSecond records on average with bursts of up to Burst. Either or both can
+// be configured on any backend
+//
+//	console {
+//		type: stdout
+//		rateLimit {
+//			perSecond: 100
+//			burst: 200
+//		}
+//		sample {
+//			first: 10
+//			thereafter: 100
+//		}
+//		summaryInterval: "10s"
+//	}
+type LimitBackend struct {
+	// Where records that aren't suppressed go
+	Backend logging.Backend
+
+	// Used to format the summary records if Backend doesn't have its own
+	Formatter logging.Formatter
+
+	// Burst defaults to PerSecond rounded up, and is always at least 1
+	PerSecond float64
+	Burst     int
+
+	First      int
+	Thereafter int
+
+	SummaryInterval time.Duration
+
+	mutex     sync.Mutex
+	keys      map[limitKey]*limitState
+	lastPrune time.Time
+	timer     *time.Timer
+	timeFn    func() time.Time
+	closed    bool
+}
+
+type limitKey struct {
+	module string
+	level  logging.Level
+	format string
+}
+
+type limitState struct {
+	tokens     float64
+	lastRefill time.Time
+
+	tick      time.Time
+	tickCount int
+
+	suppressed int
+	lastSeen   time.Time
+
+	// The first message for the key, used in the summary
+	example string
+}
+
+// Creates a LimitBackend from the rateLimit and sample children of a backend
+// config node. If neither is configured nil is returned.
+func NewLimitBackend(be logging.Backend, node *AclNode) *LimitBackend {
+	rl := node.Child("rateLimit")
+	sample := node.Child("sample")
+	if rl == nil && sample == nil {
+		return nil
+	}
+
+	l := &LimitBackend{
+		Backend:         be,
+		PerSecond:       rl.ChildAsFloat("perSecond"),
+		Burst:           rl.ChildAsInt("burst"),
+		First:           sample.ChildAsInt("first"),
+		Thereafter:      sample.ChildAsInt("thereafter"),
+		SummaryInterval: childAsDuration(node, 10*time.Second, "summaryInterval"),
+	}
+	l.Burst = l.burst()
+
+	return l
+}
+
+func (l *LimitBackend) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	if l.PerSecond > 1 {
+		return int(math.Ceil(l.PerSecond))
+	}
+	return 1
+}
+
+// How long a key has to go without records before forgetting it makes no
+// difference, which is when its sampling second is over and its bucket would
+// have filled up again.
+func (l *LimitBackend) idleTime() time.Duration {
+	idle := time.Second
+	if l.PerSecond > 0 {
+		refill := time.Duration(float64(l.burst()) / l.PerSecond * float64(time.Second))
+		if refill > idle {
+			idle = refill
+		}
+	}
+	return idle
+}
+
+// Forgets keys that have been idle for long enough and have nothing waiting
+// to be summarized. l.mutex must be held.
+func (l *LimitBackend) prune(now time.Time) {
+	idle := l.idleTime()
+	for key, state := range l.keys {
+		if state.suppressed == 0 && now.Sub(state.lastSeen) >= idle {
+			delete(l.keys, key)
+		}
+	}
+	l.lastPrune = now
+}
+
+func (l *LimitBackend) now() time.Time {
+	if l.timeFn != nil {
+		return l.timeFn()
+	}
+	return time.Now()
+}
+
+// The format string a record was logged with. go-logging doesn't export it so
+// reflection is the only way to see it. Records logged without a format, such
+// as with Info rather than Infof, use their message instead.
+func recordFormat(r *logging.Record) string {
+	f := reflect.ValueOf(r).Elem().FieldByName("fmt")
+	if f.IsValid() && !f.IsNil() {
+		return f.Elem().String()
+	}
+
+	return r.Message()
+}
+
+// Decides if a record should be passed on, counting it as suppressed if not.
+func (l *LimitBackend) allow(key limitKey, r *logging.Record) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	if l.keys == nil {
+		l.keys = make(map[limitKey]*limitState)
+		l.lastPrune = now
+	} else if now.Sub(l.lastPrune) >= l.idleTime() {
+		l.prune(now)
+	}
+
+	burst := float64(l.burst())
+	state := l.keys[key]
+	if state == nil {
+		state = &limitState{
+			tokens:     burst,
+			lastRefill: now,
+			tick:       now,
+			example:    r.Message(),
+		}
+		l.keys[key] = state
+	}
+	state.lastSeen = now
+
+	allowed := true
+
+	if l.First > 0 || l.Thereafter > 0 {
+		if now.Sub(state.tick) >= time.Second {
+			state.tick = now
+			state.tickCount = 0
+		}
+		state.tickCount++
+
+		if state.tickCount > l.First {
+			allowed = l.Thereafter > 0 && (state.tickCount-l.First)%l.Thereafter == 0
+		}
+	}
+
+	if allowed && l.PerSecond > 0 {
+		state.tokens += now.Sub(state.lastRefill).Seconds() * l.PerSecond
+		if state.tokens > burst {
+			state.tokens = burst
+		}
+		state.lastRefill = now
+
+		if state.tokens >= 1 {
+			state.tokens--
+		} else {
+			allowed = false
+		}
+	}
+
+	if !allowed {
+		state.suppressed++
+		if l.timer == nil && l.SummaryInterval > 0 && !l.closed {
+			l.timer = time.AfterFunc(l.SummaryInterval, l.Summarize)
+		}
+	}
+
+	return allowed
+}
+
+func (l *LimitBackend) Log(level logging.Level, depth int, r *logging.Record) error {
+	key := limitKey{
+		module: r.Module,
+		level:  level,
+		format: recordFormat(r),
+	}
+
+	if !l.allow(key, r) {
+		return nil
+	}
+
+	return l.Backend.Log(level, depth+1, r)
+}
+
+// Sends a summary record for every format that has had messages
+// suppressed since the last summary. This is called automatically after
+// SummaryInterval but can also be called directly, say before shutting down.
+func (l *LimitBackend) Summarize() {
+	type summary struct {
+		key     limitKey
+		n       int
+		example string
+	}
+
+	l.mutex.Lock()
+	var summaries []summary
+	for key, state := range l.keys {
+		if state.suppressed > 0 {
+			summaries = append(summaries, summary{key, state.suppressed, state.example})
+		}
+		state.suppressed = 0
+	}
+	l.prune(l.now())
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	l.mutex.Unlock()
+
+	for _, s := range summaries {
+		logTo(l.Backend, l.Formatter, s.key.module, s.key.level, "Suppressed %d messages like %q", s.n, s.example)
+	}
+}
+
+// Sends a last summary and stops the timer for them. Records can still be
+// logged through it afterwards, but nothing more is summarized. A new logging
+// config closes the limits from the one it replaced.
+func (l *LimitBackend) Close() {
+	l.mutex.Lock()
+	l.closed = true
+	l.mutex.Unlock()
+
+	l.Summarize()
+}
+
+// Creates a new record and sends it directly to a backend. Records can't be
+// built outside of go-logging, so this goes through a throwaway Logger.
+func logTo(be logging.Backend, formatter logging.Formatter, module string, level logging.Level, format string, args ...interface{}) {
+	if formatter == nil {
+		formatter = logging.DefaultFormatter
+	}
+
+	lgr := logging.MustGetLogger(module)
+	lgr.SetBackend(logging.AddModuleLevel(logging.NewBackendFormatter(be, formatter)))
+
+	switch level {
+	case logging.CRITICAL:
+		lgr.Criticalf(format, args...)
+	case logging.ERROR:
+		lgr.Errorf(format, args...)
+	case logging.WARNING:
+		lgr.Warningf(format, args...)
+	case logging.NOTICE:
+		lgr.Noticef(format, args...)
+	case logging.INFO:
+		lgr.Infof(format, args...)
+	default:
+		lgr.Debugf(format, args...)
+	}
+}
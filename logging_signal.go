@@ -0,0 +1,43 @@
+//go:build !windows
+
+package archercl
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Starts listening for SIGUSR1 and SIGUSR2, which make the global log level
+// one step more or less verbose respectively. The returned function stops
+// listening.
+//
+//	kill -USR1 <pid>   # INFO -> DEBUG
+//	kill -USR2 <pid>   # INFO -> NOTICE
+func HandleLevelSignals() (stop func()) {
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for {
+			select {
+			case sig := <-ch:
+				delta := -1
+				if sig == syscall.SIGUSR1 {
+					delta = 1
+				}
+				level := StepGlobalLevel(delta)
+				alog.Noticef("Global log level changed to %s by %s", level, sig)
+
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
@@ -0,0 +1,6 @@
+package archercl
+
+// There are no user signals on windows so this does nothing.
+func HandleLevelSignals() (stop func()) {
+	return func() {}
+}
@@ -0,0 +1,241 @@
+package archercl
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/op/go-logging"
+)
+
+// How many records a tail request gets when it doesn't say
+const DEFAULT_TAIL_RECORDS = 100
+
+// Returns the records held by the memory or channelMemory backend with the
+// given name, oldest first. The second value is false if there isn't a memory
+// backend with that name. This is safe to call while records are being logged,
+// unlike walking the backend from GetBackend yourself.
+func MemoryRecords(name string) ([]*logging.Record, bool) {
+	holder := getBackendHolder(name)
+	if holder == nil || holder.locked == nil {
+		return nil, false
+	}
+
+	return holder.locked.records(), true
+}
+
+// Reads the records out of the memory backend that is wrapped.
+func (l *lockedBackend) records() []*logging.Record {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.recordsLocked()
+}
+
+// Returns the records logged after the one numbered seq along with the number
+// to pass next time, so that a stream doesn't copy the whole buffer for every
+// new record. If more have been logged since than are kept aside then all the
+// records held are returned instead, so the caller still has to skip any it
+// has already sent.
+func (l *lockedBackend) recordsSince(seq uint64) ([]*logging.Record, uint64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.seq-seq > uint64(len(l.recent)) {
+		return l.recordsLocked(), l.seq
+	}
+
+	out := make([]*logging.Record, 0, l.seq-seq)
+	for ; seq < l.seq; seq++ {
+		out = append(out, l.recent[seq%LOCKED_RECENT_RECORDS])
+	}
+	return out, l.seq
+}
+
+// l.mutex must be held.
+func (l *lockedBackend) recordsLocked() []*logging.Record {
+	out := make([]*logging.Record, 0)
+	switch mem := l.Backend.(type) {
+	case *logging.MemoryBackend:
+		for n := mem.Head(); n != nil; n = n.Next() {
+			out = append(out, n.Record)
+		}
+
+	case *logging.ChannelMemoryBackend:
+		// The records are added by a goroutine of its own which has to be
+		// stopped while they are read
+		mem.Flush()
+		mem.Stop()
+		for n := mem.Head(); n != nil; n = n.Next() {
+			out = append(out, n.Record)
+		}
+		mem.Start()
+	}
+
+	return out
+}
+
+type tailFilter struct {
+	modules []string
+	level   logging.Level
+}
+
+func (f *tailFilter) accepts(r *logging.Record) bool {
+	if r.Level > f.level {
+		return false
+	}
+	return len(f.modules) == 0 || moduleInList(f.modules, r.Module)
+}
+
+type logTailHandler struct {
+	backend string
+}
+
+// Returns an http.Handler that shows the records held by the memory or
+// channelMemory backend with the given name. The backend is looked up on
+// every request, so it can be configured after the handler is created.
+//
+// By default the last DEFAULT_TAIL_RECORDS records are returned as plain text,
+// one per line, using the format of the backend. These query parameters
+// change what is returned
+//
+//	n=500           the number of records
+//	module=web      only records from this module, which can be repeated
+//	level=warning   only records at this level or more severe
+//
+// If the request accepts text/event-stream, or has follow=true, the response
+// is a stream of Server-Sent Events that starts with the same records and
+// then sends each new one as it is logged. The id of each event is the record
+// ID, so a client that reconnects with Last-Event-ID picks up where it left off.
+// The stream ends if a new logging config doesn't have the backend any more.
+//
+// There is no authentication here so be careful about where it is mounted.
+func LogTailHandler(backend string) http.Handler {
+	return logTailHandler{backend: backend}
+}
+
+func (h logTailHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := req.URL.Query()
+	filter := &tailFilter{
+		modules: query["module"],
+		level:   logging.DEBUG,
+	}
+	if ls := query.Get("level"); len(ls) > 0 {
+		level, err := logging.LogLevel(ls)
+		if err != nil {
+			http.Error(w, "Unknown log level '"+ls+"'", http.StatusBadRequest)
+			return
+		}
+		filter.level = level
+	}
+
+	count := DEFAULT_TAIL_RECORDS
+	if ns := query.Get("n"); len(ns) > 0 {
+		n, err := strconv.Atoi(ns)
+		if err != nil || n < 0 {
+			http.Error(w, "Bad number of records '"+ns+"'", http.StatusBadRequest)
+			return
+		}
+		count = n
+	}
+
+	records, ok := MemoryRecords(h.backend)
+	if !ok {
+		http.Error(w, "No memory backend named '"+h.backend+"'", http.StatusNotFound)
+		return
+	}
+
+	// Filter first so that n is the number of matching records
+	matching := make([]*logging.Record, 0, len(records))
+	for _, r := range records {
+		if filter.accepts(r) {
+			matching = append(matching, r)
+		}
+	}
+	if len(matching) > count {
+		matching = matching[len(matching)-count:]
+	}
+
+	follow, _ := strconv.ParseBool(query.Get("follow"))
+	if follow || strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		h.stream(w, req, filter, matching)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, r := range matching {
+		fmt.Fprintln(w, r.Formatted(0))
+	}
+}
+
+func (h logTailHandler) stream(w http.ResponseWriter, req *http.Request, filter *tailFilter, initial []*logging.Record) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	// Record IDs only ever go up, so they say which records have been sent
+	var lastID uint64
+	if ls := req.Header.Get("Last-Event-ID"); len(ls) > 0 {
+		lastID, _ = strconv.ParseUint(ls, 10, 64)
+	}
+
+	send := func(records []*logging.Record) {
+		for _, r := range records {
+			if r.ID <= lastID || !filter.accepts(r) {
+				continue
+			}
+			lastID = r.ID
+
+			fmt.Fprintf(w, "id: %d\n", r.ID)
+			for _, line := range strings.Split(r.Formatted(0), "\n") {
+				fmt.Fprintf(w, "data: %s\n", line)
+			}
+			fmt.Fprint(w, "\n")
+		}
+		flusher.Flush()
+	}
+
+	send(initial)
+
+	// Where this stream is up to in the backend it's following
+	var following *lockedBackend
+	var seq uint64
+
+	for {
+		// The backend is looked up each time since a new config replaces it
+		holder := getBackendHolder(h.backend)
+		if holder == nil || holder.locked == nil {
+			return
+		}
+		if holder.locked != following {
+			following = holder.locked
+			seq = 0
+		}
+
+		// Getting the channel before the records means nothing logged in
+		// between is missed
+		changed := following.changed()
+		var records []*logging.Record
+		records, seq = following.recordsSince(seq)
+		send(records)
+
+		select {
+		case <-req.Context().Done():
+			return
+
+		case <-changed:
+		}
+	}
+}
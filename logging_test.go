@@ -0,0 +1,1375 @@
+package archercl
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"log/syslog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+func memoryRecords(t *testing.T, name string) []*logging.Record {
+	records, ok := MemoryRecords(name)
+	if !ok {
+		t.Fatalf("Backend %s is not a memory backend", name)
+	}
+
+	return records
+}
+
+func Test_BackendFilters(t *testing.T) {
+	defer ColoredLoggingToConsole()
+
+	SetLoggingConfig(StringToACL(`
+logging {
+	level: info
+	modules web level: notice
+
+	backends {
+		quiet {
+			type: memory
+			level: warning
+		}
+
+		loud {
+			type: memory
+			modules {
+				exclude: noisy
+				web level: debug
+			}
+		}
+	}
+}
+`))
+
+	web := Logger("web")
+	other := Logger("other")
+	noisy := Logger("noisy")
+
+	web.Debug("web debug")
+	web.Warning("web warning")
+	other.Info("other info")
+	other.Debug("other debug")
+	noisy.Error("noisy error")
+
+	quiet := memoryRecords(t, "quiet")
+	if len(quiet) != 2 {
+		t.Fatalf("Expected 2 records in quiet, got %d", len(quiet))
+	}
+	for _, r := range quiet {
+		if r.Level > logging.WARNING {
+			t.Fatalf("quiet got a %v record", r.Level)
+		}
+	}
+
+	loud := memoryRecords(t, "loud")
+	if len(loud) != 3 {
+		t.Fatalf("Expected 3 records in loud, got %d", len(loud))
+	}
+	if loud[0].Message() != "web debug" {
+		t.Fatalf("Expected the web debug message first, got %q", loud[0].Message())
+	}
+	for _, r := range loud {
+		if r.Module == "noisy" {
+			t.Fatal("loud should have excluded the noisy module")
+		}
+	}
+
+	// A backend without any filter still only gets what the module level
+	// allows, even though another backend's override raised the gate
+	SetLoggingConfig(StringToACL(`
+logging {
+	level: info
+
+	backends {
+		plain {
+			type: memory
+		}
+
+		console {
+			type: memory
+			modules {
+				zzweb level: debug
+			}
+		}
+	}
+}
+`))
+
+	zzweb := Logger("zzweb")
+	zzweb.Debug("zzweb debug")
+	zzweb.Info("zzweb info")
+
+	plain := memoryRecords(t, "plain")
+	if len(plain) != 1 || plain[0].Message() != "zzweb info" {
+		t.Fatalf("Expected only the info record in plain, got %d", len(plain))
+	}
+	if console := memoryRecords(t, "console"); len(console) != 2 {
+		t.Fatalf("Expected 2 records in console, got %d", len(console))
+	}
+}
+
+func Test_RemoteSyslog(t *testing.T) {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+
+	be := NewRemoteSyslogBackend("udp", udp.LocalAddr().String())
+	be.Hostname = "host"
+	be.AppName = "app"
+	be.Facility = syslog.LOG_LOCAL0
+	be.StructuredData["meta@1"] = map[string]string{"env": `pr"od`}
+
+	logger := logging.MustGetLogger("sys")
+	logger.SetBackend(logging.AddModuleLevel(logging.NewBackendFormatter(be, logging.MustStringFormatter("%{message}"))))
+	logger.Warning("hello there")
+
+	buf := make([]byte, 1024)
+	udp.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := udp.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+
+	// local0 is 16, warning is 4 so the priority is 16*8 + 4
+	if !strings.HasPrefix(msg, "<132>1 ") {
+		t.Fatalf("Wrong header in %q", msg)
+	}
+	if !strings.HasSuffix(msg, ` host app `+strconv.Itoa(os.Getpid())+` sys [meta@1 env="pr\"od"] hello there`) {
+		t.Fatalf("Wrong message %q", msg)
+	}
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	be = NewRemoteSyslogBackend("tcp", tcp.Addr().String())
+	be.Protocol = SYSLOG_RFC3164
+	logger.SetBackend(logging.AddModuleLevel(logging.NewBackendFormatter(be, logging.MustStringFormatter("%{message}"))))
+	logger.Info("one")
+	logger.Info("two")
+	defer be.Close()
+
+	conn, err := tcp.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for _, expected := range []string{"one", "two"} {
+		var length int
+		_, err = fmt.Fscanf(reader, "%d ", &length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame := make([]byte, length)
+		_, err = io.ReadFull(reader, frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(frame), "<14>") || !strings.HasSuffix(string(frame), "]: "+expected) {
+			t.Fatalf("Wrong rfc3164 frame %q", frame)
+		}
+	}
+}
+
+// Reads one octet counted frame from a tcp syslog connection
+func readSyslogFrame(t *testing.T, reader *bufio.Reader) string {
+	var length int
+	_, err := fmt.Fscanf(reader, "%d ", &length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, length)
+	_, err = io.ReadFull(reader, frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(frame)
+}
+
+func acceptWithin(l net.Listener, d time.Duration) (net.Conn, error) {
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(d))
+	return l.Accept()
+}
+
+func Test_RemoteSyslogReconnect(t *testing.T) {
+	// Nothing is listening to start with
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	be := NewRemoteSyslogBackend("tcp", addr)
+	be.ReconnectDelay = 20 * time.Millisecond
+	defer be.Close()
+
+	logger := logging.MustGetLogger("sys")
+	logger.SetBackend(logging.AddModuleLevel(logging.NewBackendFormatter(be, logging.MustStringFormatter("%{message}"))))
+	logger.Info("one")
+	logger.Info("two")
+	time.Sleep(50 * time.Millisecond)
+	if be.Pending() != 2 {
+		t.Fatalf("Expected 2 messages waiting for a connection, got %d", be.Pending())
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("Could not listen on %s again: %v", addr, err)
+	}
+	defer l.Close()
+
+	conn, err := acceptWithin(l, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	for _, expected := range []string{"one", "two"} {
+		if frame := readSyslogFrame(t, reader); !strings.HasSuffix(frame, " "+expected) {
+			t.Fatalf("Expected %q after connecting, got %q", expected, frame)
+		}
+	}
+
+	// A lost connection is replaced
+	conn.Close()
+	for i := 0; ; i++ {
+		if i == 100 {
+			t.Fatal("The backend never reconnected")
+		}
+		logger.Infof("after %d", i)
+		conn, err = acceptWithin(l, 50*time.Millisecond)
+		if err == nil {
+			break
+		}
+	}
+	defer conn.Close()
+	if frame := readSyslogFrame(t, bufio.NewReader(conn)); !strings.Contains(frame, " after ") {
+		t.Fatalf("Expected a message after reconnecting, got %q", frame)
+	}
+
+	// A server that stops reading doesn't hold up logging
+	stuck, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+	go func() {
+		c, err := stuck.Accept()
+		if err == nil {
+			defer c.Close()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+
+	be = NewRemoteSyslogBackend("tcp", stuck.Addr().String())
+	be.BufferSize = 10
+	be.WriteTimeout = 100 * time.Millisecond
+	defer be.Close()
+	logger.SetBackend(logging.AddModuleLevel(logging.NewBackendFormatter(be, logging.MustStringFormatter("%{message}"))))
+
+	big := strings.Repeat("x", 64*1024)
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		logger.Info(big)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Logging took %v with a stuck server", elapsed)
+	}
+	if be.Dropped() == 0 {
+		t.Fatal("Expected messages to be dropped from the full buffer")
+	}
+}
+
+func Test_RemoteSyslogTLS(t *testing.T) {
+	if _, err := makeRemoteSyslogBackend(StringToACL(`network: tpc, address: "localhost:514"`)); err == nil {
+		t.Fatal("Expected an error for an unknown network")
+	}
+
+	// A self signed certificate for the server which is given to the
+	// backend as its only root CA, without any client certificate
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "syslog test"},
+		DNSNames:              []string{"logs.test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	be, err := makeRemoteSyslogBackend(StringToACL(fmt.Sprintf(`
+network: tls
+address: %q
+tls {
+	rootCAs: %q
+	serverName: "logs.test"
+}
+`, l.Addr().String(), caFile)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.(*RemoteSyslogBackend).Close()
+
+	logger := logging.MustGetLogger("sys")
+	logger.SetBackend(logging.AddModuleLevel(logging.NewBackendFormatter(be, logging.MustStringFormatter("%{message}"))))
+	logger.Warning("over tls")
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if frame := readSyslogFrame(t, bufio.NewReader(conn)); !strings.HasSuffix(frame, " over tls") {
+		t.Fatalf("Wrong tls frame %q", frame)
+	}
+}
+
+func Test_DelayedBackend(t *testing.T) {
+	logger := logging.MustGetLogger("delayed")
+	formatter := logging.MustStringFormatter("%{message}")
+
+	d := NewDelayedBackend(3)
+	logger.SetBackend(logging.AddModuleLevel(logging.NewBackendFormatter(d, formatter)))
+	for i := 0; i < 5; i++ {
+		logger.Infof("%d", i)
+	}
+	if d.Pending() != 3 || d.Dropped() != 2 {
+		t.Fatalf("Expected 3 pending and 2 dropped, got %d and %d", d.Pending(), d.Dropped())
+	}
+
+	mem := logging.NewMemoryBackend(10)
+	d.SetRealBackend(mem)
+	logger.Info("5")
+
+	got := ""
+	for n := mem.Head(); n != nil; n = n.Next() {
+		got += n.Record.Formatted(0)
+	}
+	if got != "2345" {
+		t.Fatalf("Expected the newest records to be kept, got %q", got)
+	}
+
+	// Nothing goes anywhere until the real backend shows up, and then all of
+	// it arrives in order from the async goroutine
+	mem = logging.NewMemoryBackend(100)
+	d = NewAsyncBackend(nil, 0, DROP_NEWEST)
+	logger.SetBackend(logging.AddModuleLevel(logging.NewBackendFormatter(d, formatter)))
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				logger.Info("x")
+			}
+		}()
+	}
+	wg.Wait()
+
+	d.SetRealBackend(mem)
+	d.Close()
+
+	count := 0
+	for n := mem.Head(); n != nil; n = n.Next() {
+		count++
+	}
+	if count != 40 || d.Dropped() != 0 {
+		t.Fatalf("Expected 40 records and none dropped, got %d and %d", count, d.Dropped())
+	}
+
+	// A configured async queue is bounded even without a maxCache
+	if _, err := makeDelayedBackend(StringToACL("async: true, maxCache: -1")); err == nil {
+		t.Fatal("Expected an error for an unbounded async queue")
+	}
+	// An explicit 0 holds nothing when synchronous and is the default queue
+	// size when async
+	be, err := makeDelayedBackend(StringToACL("maxCache: 0"))
+	if err != nil || be.(*DelayedBackend).MaxCache != 0 {
+		t.Fatalf("Expected a maxCache of 0, got %v", err)
+	}
+	logger.SetBackend(logging.AddModuleLevel(logging.NewBackendFormatter(be, formatter)))
+	logger.Info("dropped")
+	if be.(*DelayedBackend).Pending() != 0 {
+		t.Fatal("Nothing should be held with a maxCache of 0")
+	}
+	if be, err = makeDelayedBackend(StringToACL("async: true, maxCache: 0")); err != nil {
+		t.Fatalf("An async maxCache of 0 should be allowed: %v", err)
+	}
+	be.(*DelayedBackend).Close()
+	if be, _ = makeDelayedBackend(StringToACL("drop: newest")); be.(*DelayedBackend).MaxCache != -1 {
+		t.Fatal("Without a maxCache everything should be held")
+	}
+
+	be, err = makeDelayedBackend(StringToACL("async: true, drop: newest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d = be.(*DelayedBackend)
+	defer d.Close()
+	logger.SetBackend(logging.AddModuleLevel(logging.NewBackendFormatter(d, formatter)))
+	for i := 0; i < DEFAULT_ASYNC_QUEUE+5; i++ {
+		logger.Info("x")
+	}
+	if d.Pending() != DEFAULT_ASYNC_QUEUE || d.Dropped() != 5 {
+		t.Fatalf("Expected %d pending and 5 dropped, got %d and %d", DEFAULT_ASYNC_QUEUE, d.Pending(), d.Dropped())
+	}
+}
+
+func Test_LimitBackend(t *testing.T) {
+	defer ColoredLoggingToConsole()
+
+	SetLoggingConfig(StringToACL(`
+logging {
+	level: debug
+	backends mem {
+		type: memory
+		format: "%{message}"
+		sample { first: 2, thereafter: 3 }
+		summaryInterval: 0
+	}
+}
+`))
+
+	// The same format from two places is limited together
+	lgr := Logger("hot")
+	for i := 0; i < 10; i++ {
+		if i%2 == 0 {
+			lgr.Infof("loop %d", i)
+		} else {
+			lgr.Infof("loop %d", i)
+		}
+	}
+	lgr.Info("something else")
+
+	limit := getBackendHolder("mem").Limit
+	limit.mutex.Lock()
+	formats := make([]string, 0)
+	for key := range limit.keys {
+		formats = append(formats, key.format)
+	}
+	limit.mutex.Unlock()
+	sort.Strings(formats)
+	if strings.Join(formats, ",") != "loop %d,something else" {
+		t.Errorf("Expected records to be grouped by format, got %q", formats)
+	}
+	limit.Summarize()
+
+	expected := []string{"loop 0", "loop 1", "loop 4", "loop 7", "something else", `Suppressed 6 messages like "loop 0"`}
+	records := memoryRecords(t, "mem")
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %d records, got %d", len(expected), len(records))
+	}
+	for ix, r := range records {
+		if r.Message() != expected[ix] {
+			t.Fatalf("Expected %q but got %q", expected[ix], r.Message())
+		}
+	}
+
+	// With the clock stopped only the burst gets through
+	mem := logging.NewMemoryBackend(100)
+	now := time.Now()
+	l := &LimitBackend{
+		Backend:   mem,
+		PerSecond: 5,
+		Burst:     3,
+		timeFn:    func() time.Time { return now },
+	}
+	lgr = logging.MustGetLogger("hot")
+	lgr.SetBackend(logging.AddModuleLevel(l))
+	for i := 0; i < 10; i++ {
+		lgr.Info("burst")
+	}
+	now = now.Add(time.Second)
+	for i := 0; i < 10; i++ {
+		lgr.Info("burst")
+	}
+
+	count := 0
+	for n := mem.Head(); n != nil; n = n.Next() {
+		count++
+	}
+	if count != 6 {
+		t.Fatalf("Expected 6 records through the rate limit, got %d", count)
+	}
+
+	// Less than one a second still lets some through
+	l = NewLimitBackend(logging.NewMemoryBackend(100), StringToACL("rateLimit perSecond: 0.5"))
+	l.timeFn = func() time.Time { return now }
+	lgr.SetBackend(logging.AddModuleLevel(l))
+	allowed := 0
+	for i := 0; i < 6; i++ {
+		if l.allow(limitKey{module: "hot", format: "slow"}, &logging.Record{}) {
+			allowed++
+		}
+		now = now.Add(time.Second)
+	}
+	if l.Burst != 1 || allowed != 3 {
+		t.Fatalf("Expected a burst of 1 and 3 records allowed, got %d and %d", l.Burst, allowed)
+	}
+
+	// Keys that have gone quiet are forgotten, but not before their
+	// suppressed messages are summarized
+	for i := 0; i < 100; i++ {
+		l.allow(limitKey{module: "hot", format: fmt.Sprint(i)}, &logging.Record{})
+		l.allow(limitKey{module: "hot", format: fmt.Sprint(i)}, &logging.Record{})
+	}
+	now = now.Add(time.Hour)
+	l.allow(limitKey{module: "hot", format: "new"}, &logging.Record{})
+	if len(l.keys) != 102 {
+		t.Fatalf("Expected keys with suppressed messages to be kept, got %d", len(l.keys))
+	}
+	l.Summarize()
+	now = now.Add(time.Hour)
+	l.Summarize()
+	if len(l.keys) != 0 {
+		t.Fatalf("Expected idle keys to be forgotten, got %d", len(l.keys))
+	}
+}
+
+func Test_LogLevelHandler(t *testing.T) {
+	defer ColoredLoggingToConsole()
+
+	cfg := StringToACL(`
+logging {
+	level: info
+	modules db level: warning
+	backends mem type: memory
+}
+`)
+	SetLoggingConfig(cfg)
+	db := Logger("db")
+	Logger("web")
+
+	server := httptest.NewServer(LogLevelHandler())
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"?module=db&level=debug", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("PUT failed with %d", res.StatusCode)
+	}
+
+	req, _ = http.NewRequest(http.MethodPut, server.URL, strings.NewReader(`{"level":"error"}`))
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := levelState{}
+	err = json.NewDecoder(res.Body).Decode(&state)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Global != "ERROR" || state.Modules["db"] != "DEBUG" || state.Modules["web"] != "ERROR" {
+		t.Fatalf("Wrong levels %v", state)
+	}
+
+	db.Debug("now visible")
+	visible := false
+	for _, r := range memoryRecords(t, "mem") {
+		visible = visible || r.Module == "db"
+	}
+	if !visible {
+		t.Fatal("The db module should be logging at debug")
+	}
+
+	// The changes are in the config so setting it again keeps them
+	if cfg.ChildAsString("logging", "modules", "db", "level") != "debug" || cfg.ChildAsString("logging", "level") != "error" {
+		t.Fatalf("Changes were not written back into the config\n%v", cfg)
+	}
+	SetLoggingConfig(cfg)
+	if GlobalLevel() != logging.ERROR || ModuleLevels()["db"] != logging.DEBUG {
+		t.Fatal("Levels were lost after SetLoggingConfig")
+	}
+}
+
+// Run this with -race. The reload path in a real program reconfigures logging
+// while every other goroutine keeps calling Logger() and logging.
+func Test_ConcurrentReconfigure(t *testing.T) {
+	defer ColoredLoggingToConsole()
+
+	configs := []*AclNode{
+		StringToACL(`logging { level: debug, backends a { type: memory, level: info } }`),
+		StringToACL(`logging { level: warning, modules m1 level: debug, backends b { type: memory, modules m2 level: debug } }`),
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				lgr := Logger(fmt.Sprintf("m%d", (g+i)%4))
+				lgr.Debugf("debug %d", i)
+				lgr.Warningf("warning %d", i)
+				GetBackend("a")
+				ModuleLevels()
+			}
+		}(g)
+	}
+
+	for i := 0; i < 200; i++ {
+		SetLoggingConfig(configs[i%2])
+		if i%10 == 0 {
+			StepGlobalLevel(1)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func Test_LoggingErrorPolicy(t *testing.T) {
+	defer ColoredLoggingToConsole()
+
+	SetLoggingConfig(StringToACL(`logging backends old type: memory`))
+
+	broken := StringToACL(`
+logging {
+	backends {
+		mem type: memory
+		noFile type: file
+		bad {
+			type: stdout
+			level: chatty
+		}
+		what type: teleport
+	}
+}
+`)
+
+	err := SetLoggingConfigWithPolicy(broken, LOGGING_ERRORS_FAIL)
+	problems, ok := err.(LoggingConfigError)
+	if !ok || len(problems) != 3 {
+		t.Fatalf("Expected 3 problems, got %v", err)
+	}
+	if problems[0].Path != "logging backends noFile" || problems[2].Name != "what" {
+		t.Fatalf("Problems are in the wrong order %v", err)
+	}
+	if GetBackend("old") == nil || GetBackend("mem") != nil {
+		t.Fatal("A failed config should leave the old backends in place")
+	}
+
+	err = SetLoggingConfig(broken)
+	if err == nil {
+		t.Fatal("Expected an error from SetLoggingConfig")
+	}
+	if GetBackend("mem") == nil || GetBackend("noFile") != nil {
+		t.Fatal("Only the working backends should be configured")
+	}
+
+	// Nothing changes when a backend fails after a test memory backend, and
+	// the backends that were built are closed
+	closed := false
+	RegisterBackendType("closeCheck", func(node *AclNode) (logging.Backend, error) {
+		return &closeCheckBackend{closed: &closed}, nil
+	})
+	defer RegisterBackendType("closeCheck", nil)
+
+	SetLoggingConfig(StringToACL(`logging backends old type: memory`))
+	err = SetLoggingConfigWithPolicy(StringToACL(`
+logging backends {
+	test {
+		type: memory
+		forTesting: true
+	}
+	check type: closeCheck
+	noFile type: file
+}
+`), LOGGING_ERRORS_FAIL)
+	if err == nil || !closed {
+		t.Fatalf("Expected an error and the built backend to be closed, got %v %v", err, closed)
+	}
+	Logger("policy").Warning("still the old config")
+	old := memoryRecords(t, "old")
+	if GetBackend("test") != nil || old[len(old)-1].Message() != "still the old config" {
+		t.Fatal("The old config should still be in use")
+	}
+
+	SetLoggingConfigWithPolicy(broken, LOGGING_ERRORS_STDERR)
+	if _, ok := GetBackend("noFile").(*logging.LogBackend); !ok {
+		t.Fatal("The broken backend should have been replaced with stderr")
+	}
+	if !strings.Contains(memoryRecords(t, "mem")[0].Message(), "logging backends bad: Unknown log level 'chatty'") {
+		t.Fatal("Expected a warning about the problems")
+	}
+}
+
+type closeCheckBackend struct {
+	closed *bool
+}
+
+func (b *closeCheckBackend) Log(level logging.Level, depth int, r *logging.Record) error {
+	return nil
+}
+
+func (b *closeCheckBackend) Close() error {
+	*b.closed = true
+	return nil
+}
+
+func Test_ReloadClosesBackends(t *testing.T) {
+	defer ColoredLoggingToConsole()
+
+	var closed []*bool
+	RegisterBackendType("closeCheck", func(node *AclNode) (logging.Backend, error) {
+		c := new(bool)
+		closed = append(closed, c)
+		return &closeCheckBackend{closed: c}, nil
+	})
+	defer RegisterBackendType("closeCheck", nil)
+
+	uiClosed := false
+	AddExtraBackend("ui", &closeCheckBackend{closed: &uiClosed})
+	defer RemoveExtraBackend("ui")
+
+	cfg := `logging backends { check { type: closeCheck, rateLimit perSecond: 1 }, ui level: info }`
+	var limits []*LimitBackend
+	for i := 0; i < 3; i++ {
+		SetLoggingConfig(StringToACL(cfg))
+		limits = append(limits, getBackendHolder("check").Limit)
+	}
+
+	for ix, c := range closed {
+		if *c != (ix < len(closed)-1) {
+			t.Fatalf("Only the replaced backends should be closed, backend %d is %v", ix, *c)
+		}
+	}
+	for ix, l := range limits {
+		l.mutex.Lock()
+		if l.closed != (ix < len(limits)-1) {
+			t.Errorf("Only the replaced limits should be closed, limit %d is %v", ix, l.closed)
+		}
+		l.mutex.Unlock()
+	}
+	if uiClosed {
+		t.Fatal("An extra backend shouldn't be closed")
+	}
+
+	// A saved setup stays open until it's restored
+	state := SaveLogging()
+	SetLoggingConfig(StringToACL(cfg))
+	if *closed[2] {
+		t.Fatal("A saved backend was closed")
+	}
+	RestoreLogging(state)
+	if *closed[2] || !*closed[3] {
+		t.Fatal("Restoring should close the backend it replaced and keep the saved one")
+	}
+}
+
+func Test_RestoreLogging(t *testing.T) {
+	defer ColoredLoggingToConsole()
+
+	closed := false
+	RegisterBackendType("closeCheck", func(node *AclNode) (logging.Backend, error) {
+		return &closeCheckBackend{closed: &closed}, nil
+	})
+	defer RegisterBackendType("closeCheck", nil)
+
+	SetLoggingConfig(StringToACL(`logging { level: notice, backends saved type: memory }`))
+	saved := GetBackend("saved")
+	state := SaveLogging()
+
+	SetLoggingConfig(StringToACL(`logging { level: debug, backends check type: closeCheck }`))
+	Logger("restored").Debug("not kept")
+	RestoreLogging(state)
+
+	if GetBackend("saved") != saved || GetBackend("check") != nil || !closed {
+		t.Fatal("Expected the saved backend back and the other one closed")
+	}
+	Logger("restored").Info("too verbose")
+	Logger("restored").Notice("kept")
+	records := memoryRecords(t, "saved")
+	if len(records) != 1 || records[0].Message() != "kept" {
+		t.Fatalf("Expected only the notice in the saved backend, got %d records", len(records))
+	}
+}
+
+func Test_FactoryLogs(t *testing.T) {
+	defer ColoredLoggingToConsole()
+
+	// A factory that logs and looks at other backends used to deadlock
+	RegisterBackendType("chatty", func(n *AclNode) (logging.Backend, error) {
+		Logger("factory").Info("building a backend")
+		GetBackend("mem")
+		return logging.NewMemoryBackend(10), nil
+	})
+	defer RegisterBackendType("chatty", nil)
+
+	done := make(chan error)
+	go func() {
+		done <- SetLoggingConfig(StringToACL(`logging backends { mem type: memory, chatty type: chatty }`))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SetLoggingConfig deadlocked with a factory that logs")
+	}
+
+	if GetBackend("chatty") == nil {
+		t.Fatal("The chatty backend wasn't configured")
+	}
+}
+
+func Test_BackendRegistry(t *testing.T) {
+	defer ColoredLoggingToConsole()
+
+	var node *AclNode
+	captured := logging.NewMemoryBackend(10)
+	RegisterBackendType("capture", func(n *AclNode) (logging.Backend, error) {
+		node = n
+		return captured, nil
+	})
+	defer RegisterBackendType("capture", nil)
+
+	ui := logging.NewMemoryBackend(10)
+	AddExtraBackend("ui", ui)
+	defer RemoveExtraBackend("ui")
+	other := logging.NewMemoryBackend(10)
+	AddExtraBackend("other", other)
+	defer RemoveExtraBackend("other")
+
+	err := SetLoggingConfig(StringToACL(`
+logging {
+	level: debug
+	backends {
+		cap {
+			type: capture
+			topic: "logs"
+			level: warning
+		}
+		ui {
+			format: "ui %{message}"
+			level: info
+		}
+	}
+}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.ChildAsString("topic") != "logs" || GetBackend("cap") != captured {
+		t.Fatal("The factory wasn't used for the capture type")
+	}
+
+	lgr := NewModuleLogger("plug")
+	lgr.Debug("debug")
+	lgr.Info("info")
+	lgr.Warning("warning")
+
+	count := func(mem *logging.MemoryBackend) int {
+		n := 0
+		for r := mem.Head(); r != nil; r = r.Next() {
+			if r.Record.Module == "plug" {
+				n++
+			}
+		}
+		return n
+	}
+	if count(captured) != 1 || count(ui) != 2 || count(other) != 3 {
+		t.Fatalf("Wrong number of records %d %d %d", count(captured), count(ui), count(other))
+	}
+	if ui.Head().Record.Formatted(0) != "ui info" {
+		t.Fatalf("The ui backend wasn't formatted from the config, got %q", ui.Head().Record.Formatted(0))
+	}
+}
+
+func Test_SlogHandler(t *testing.T) {
+	defer ColoredLoggingToConsole()
+
+	SetLoggingConfig(StringToACL(`
+logging {
+	level: info
+	modules "api.db" level: debug
+	slog {
+		moduleKey: component
+		groupAsModule: true
+	}
+	backends mem {
+		type: memory
+		format: "%{level} %{message}"
+	}
+}
+`))
+
+	lgr := slog.New(NewSlogHandler(nil))
+	lgr.Debug("hidden")
+	lgr.Info("hello", "user", "bob smith", "n", 3)
+	lgr.With("component", "web").Warn("from web", slog.Group("req", "id", 7))
+	lgr.WithGroup("api").WithGroup("db").Debug("query")
+	Logger("plain").Info("go-logging")
+
+	expected := []string{
+		`slog INFO hello user="bob smith" n=3`,
+		`web WARNING from web req.id=7`,
+		`api.db DEBUG query`,
+		`plain INFO go-logging`,
+	}
+	records := memoryRecords(t, "mem")
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %d records, got %d", len(expected), len(records))
+	}
+	for ix, r := range records {
+		got := r.Module + " " + r.Formatted(0)
+		if got != expected[ix] {
+			t.Fatalf("Expected %q but got %q", expected[ix], got)
+		}
+	}
+
+	// A module from an attribute can be more verbose than the handler's own
+	lgr.Debug("from the attribute", "component", "api.db")
+	lgr.Debug("still hidden", "component", "web")
+	records = memoryRecords(t, "mem")
+	if got := records[len(records)-1]; got.Module != "api.db" || got.Formatted(0) != "DEBUG from the attribute" {
+		t.Fatalf("Expected the debug record for api.db, got %s %q", got.Module, got.Formatted(0))
+	}
+	if len(records) != len(expected)+1 {
+		t.Fatalf("Expected only one more record, got %d", len(records)-len(expected))
+	}
+
+	// Modules that only come from attributes get the right level without
+	// being kept as loggers
+	lgr.Debug("per request", "component", "api.db.req42")
+	lgr.With("component", "api.db.req43").Debug("per request")
+	lgr.With("component", "web.req44").Debug("hidden")
+	records = memoryRecords(t, "mem")
+	if len(records) != len(expected)+3 || records[len(records)-1].Module != "api.db.req43" {
+		t.Fatalf("Expected two more records, got %d", len(records)-len(expected)-1)
+	}
+	registryMutex.RLock()
+	for _, name := range []string{"api.db.req42", "api.db.req43", "web.req44"} {
+		if loggers[name] != nil {
+			t.Errorf("A logger was kept for %s", name)
+		}
+	}
+	registryMutex.RUnlock()
+
+	if LoggingLevel(SlogLevel(logging.NOTICE)) != logging.NOTICE || LoggingLevel(slog.LevelError+1) != logging.CRITICAL {
+		t.Fatal("Level conversion is wrong")
+	}
+}
+
+func Test_StdLogBridge(t *testing.T) {
+	defer ColoredLoggingToConsole()
+
+	SetLoggingConfig(StringToACL(`
+logging {
+	level: debug
+	stdlib {
+		module: thirdparty
+		level: warning
+	}
+	backends mem {
+		type: memory
+		format: "%{level} %{message}"
+	}
+}
+`))
+
+	log.Printf("from the std %s", "lib")
+
+	w := WriterFor("lib", logging.ERROR)
+	fmt.Fprint(w, "one\ntw")
+	fmt.Fprint(w, "o\r\n\nthree\n")
+
+	expected := []string{
+		"thirdparty WARNING from the std lib",
+		"lib ERROR one",
+		"lib ERROR two",
+		"lib ERROR three",
+	}
+	records := memoryRecords(t, "mem")
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %d records, got %d", len(expected), len(records))
+	}
+	for ix, r := range records {
+		got := r.Module + " " + r.Formatted(0)
+		if got != expected[ix] {
+			t.Fatalf("Expected %q but got %q", expected[ix], got)
+		}
+	}
+
+	// Without the stdlib block the original output comes back
+	SetLoggingConfig(StringToACL(`logging backends mem type: memory`))
+	if _, ok := log.Writer().(*logWriter); ok {
+		t.Fatal("The standard log output was not restored")
+	}
+}
+
+func Test_ModuleLoggerFields(t *testing.T) {
+	defer ColoredLoggingToConsole()
+
+	var out strings.Builder
+	client := &Client{Writer: &out, BufferSize: 100}
+	AddExtraBackend("json", client)
+	defer RemoveExtraBackend("json")
+
+	SetLoggingConfig(StringToACL(`
+logging {
+	level: debug
+	backends {
+		mem {
+			type: memory
+			format: "%{shortfunc} %{message}%{fields}"
+		}
+		json level: warning
+	}
+}
+`))
+
+	lgr := NewModuleLogger("fields")
+	lgr.Info("no fields")
+
+	rlog := lgr.With("request", 42, "tenant", "big co")
+	ctx := ContextWithLogger(context.Background(), rlog)
+	LoggerFromContext(ctx, lgr).Infof("%d%% done", 50)
+	LoggerFromContext(context.Background(), lgr).Debug("plain", "args")
+	rlog.With("request", 43).Warning("100% broken")
+
+	expected := []string{
+		"Test_ModuleLoggerFields no fields",
+		`Test_ModuleLoggerFields 50% done request=42 tenant="big co"`,
+		"Test_ModuleLoggerFields plain args",
+		`Test_ModuleLoggerFields 100% broken request=43 tenant="big co"`,
+	}
+	records := memoryRecords(t, "mem")
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %d records, got %d", len(expected), len(records))
+	}
+	for ix, r := range records {
+		if r.Formatted(0) != expected[ix] {
+			t.Fatalf("Expected %q but got %q", expected[ix], r.Formatted(0))
+		}
+	}
+
+	msg := make(map[string]interface{})
+	err := json.Unmarshal([]byte(out.String()), &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg["request"] != float64(43) || msg["tenant"] != "big co" || msg["module"] != "fields" {
+		t.Fatalf("Fields missing from the JSON %v", msg)
+	}
+
+	// The exported default is still something go-logging can use itself
+	if _, err := logging.NewStringFormatter(DEFAULT_FORMAT_STRING); err != nil {
+		t.Fatalf("DEFAULT_FORMAT_STRING should work with go-logging: %v", err)
+	}
+	if _, err := NewFormatter(DEFAULT_FIELDS_FORMAT_STRING); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_LogTailHandler(t *testing.T) {
+	defer ColoredLoggingToConsole()
+
+	SetLoggingConfig(StringToACL(`
+logging {
+	level: debug
+	backends tail {
+		type: memory
+		format: "%{level} %{message}"
+	}
+}
+`))
+
+	web := Logger("tailweb")
+	db := Logger("taildb")
+	web.Info("web info")
+	web.Warning("web warning")
+	db.Error("db error")
+	web.Error("web error")
+
+	server := httptest.NewServer(LogTailHandler("tail"))
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "?module=tailweb&level=warning&n=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "WARNING web warning\nERROR web error\n" {
+		t.Fatalf("Wrong tail %q", body)
+	}
+
+	res, _ = http.Get(server.URL + "?n=1")
+	body, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "ERROR web error\n" {
+		t.Fatalf("Wrong tail with n=1 %q", body)
+	}
+
+	res, _ = http.Get(server.URL + "?level=loud")
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected a bad request, got %d", res.StatusCode)
+	}
+
+	// Streaming sends the last record and then the new ones that match
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"?n=1&module=taildb", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	reader := bufio.NewReader(res.Body)
+	readEvent := func() string {
+		data := ""
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line == "\n" {
+				return data
+			}
+			if strings.HasPrefix(line, "data: ") {
+				data += strings.TrimSuffix(line[6:], "\n")
+			}
+		}
+	}
+
+	if ev := readEvent(); ev != "ERROR db error" {
+		t.Fatalf("Wrong first event %q", ev)
+	}
+	web.Error("not for this stream")
+	db.Notice("db notice")
+	if ev := readEvent(); ev != "NOTICE db notice" {
+		t.Fatalf("Wrong streamed event %q", ev)
+	}
+
+	// Streams are only given what's new unless they have fallen too far behind
+	locked := getBackendHolder("tail").locked
+	_, seq := locked.recordsSince(0)
+	db.Notice("only new")
+	if records, next := locked.recordsSince(seq); len(records) != 1 || records[0].Message() != "only new" || next != seq+1 {
+		t.Fatalf("Expected just the new record, got %d", len(records))
+	}
+	for i := 0; i <= LOCKED_RECENT_RECORDS; i++ {
+		web.Debug("filler")
+	}
+	if records, _ := locked.recordsSince(seq); len(records) != len(locked.records()) {
+		t.Fatalf("Expected every held record after falling behind, got %d", len(records))
+	}
+	if ev := readEvent(); ev != "NOTICE only new" {
+		t.Fatalf("Wrong streamed event %q", ev)
+	}
+
+	// The stream ends when the backend goes away
+	ColoredLoggingToConsole()
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Fatalf("Expected the stream to end, got %v", err)
+	}
+}
+
+func Test_HierarchicalModules(t *testing.T) {
+	defer ColoredLoggingToConsole()
+
+	if strings.Join(ModuleAncestors("db.pool/conn"), ",") != "db.pool/conn,db.pool,db" {
+		t.Fatalf("Wrong ancestors %v", ModuleAncestors("db.pool/conn"))
+	}
+	for _, c := range []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"http.*", "http.client", true},
+		{"http.*", "http", false},
+		{"*.pool", "db.pool", true},
+		{"d?.pool", "db.pool", true},
+		{"db", "db.pool", false},
+	} {
+		if MatchModule(c.pattern, c.name) != c.match {
+			t.Fatalf("MatchModule(%q, %q) should be %v", c.pattern, c.name, c.match)
+		}
+	}
+
+	SetLoggingConfig(StringToACL(`
+logging {
+	level: error
+	modules {
+		hdb level: warning
+		"hdb.pool.*" level: info
+		"hdb.pool.slow" level: debug
+		"hhttp.*" level: debug
+	}
+	backends mem {
+		type: memory
+		modules exclude: "hhttp.noisy"
+	}
+}
+`))
+
+	levels := map[string]logging.Level{
+		"hdb":             logging.WARNING,
+		"hdb.pool":        logging.WARNING,
+		"hdb.pool.conn":   logging.INFO,
+		"hdb.pool/conn":   logging.WARNING,
+		"hdb.pool.slow":   logging.DEBUG,
+		"hdb.other.thing": logging.WARNING,
+		"hhttp":           logging.ERROR,
+		"hhttp.client":    logging.DEBUG,
+		"hweb":            logging.ERROR,
+	}
+	for name, expected := range levels {
+		Logger(name)
+		if ModuleLevels()[name] != expected {
+			t.Fatalf("%s should be at %v but is %v", name, expected, ModuleLevels()[name])
+		}
+	}
+
+	// Changing a parent at runtime moves the children that inherit from it
+	SetModuleLevel("hdb", logging.NOTICE)
+	if ModuleLevels()["hdb.other.thing"] != logging.NOTICE || ModuleLevels()["hdb.pool.conn"] != logging.INFO {
+		t.Fatal("Runtime changes weren't inherited")
+	}
+
+	if Logger("hdb") != Logger("hdb") {
+		t.Fatal("Logger should return the same logger for the same name")
+	}
+
+	Logger("hhttp.noisy.inner").Error("excluded")
+	Logger("hhttp.client").Debug("included")
+	records := memoryRecords(t, "mem")
+	if len(records) != 1 || records[0].Module != "hhttp.client" {
+		t.Fatalf("Excluding a module should exclude its children, got %d records", len(records))
+	}
+}
+
+func Test_FormatPresets(t *testing.T) {
+	defer ColoredLoggingToConsole()
+
+	err := SetLoggingConfig(StringToACL(`
+logging {
+	level: debug
+	format: "%{message} %{nope}"
+	backends {
+		logfmt {
+			type: memory
+			format: "preset:logfmt"
+		}
+		compact {
+			type: memory
+			format: "preset:compact"
+		}
+		typo {
+			type: memory
+			format: "preset:fancy"
+		}
+	}
+}
+`))
+	problems, ok := err.(LoggingConfigError)
+	if !ok || len(problems) != 2 {
+		t.Fatalf("Expected 2 problems, got %v", err)
+	}
+	if problems[0].Path != "logging format" || !strings.Contains(problems[0].Error(), `Invalid format "%{message} %{nope}": unknown variable: nope`) {
+		t.Fatalf("Wrong error for the global format: %v", problems[0])
+	}
+	if problems[1].Path != "logging backends typo format" || !strings.Contains(problems[1].Error(), "Unknown format preset 'fancy'") {
+		t.Fatalf("Wrong error for the backend format: %v", problems[1])
+	}
+
+	logLine := callerLine() + 1
+	NewModuleLogger("fmtweb").With("user", `bob "the" builder`, "n", 1).Warning("a=b c")
+
+	line := memoryRecords(t, "logfmt")[0].Formatted(0)
+	if !strings.HasPrefix(line, "time=") {
+		t.Fatalf("Wrong logfmt %q", line)
+	}
+	suffix := ` level=warning module=fmtweb caller=logging_test.go:` + strconv.Itoa(logLine) + ` msg="a=b c" user="bob \"the\" builder" n=1`
+	if !strings.HasSuffix(line, suffix) {
+		t.Fatalf("Wrong logfmt\n%q\nshould end with\n%q", line, suffix)
+	}
+
+	line = memoryRecords(t, "compact")[0].Formatted(0)
+	if !strings.HasSuffix(line, ` WARN fmtweb a=b c user="bob \"the\" builder" n=1`) {
+		t.Fatalf("Wrong compact format %q", line)
+	}
+
+	for name := range FormatPresets {
+		if _, err := NewFormatter(FORMAT_PRESET_PREFIX + name); err != nil {
+			t.Fatalf("Preset %s is broken: %v", name, err)
+		}
+	}
+}
+
+func callerLine() int {
+	_, _, line, _ := runtime.Caller(1)
+	return line
+}
@@ -13,6 +13,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -156,6 +157,19 @@ func (c *Client) Log(level logging.Level, calldepth int, rec *logging.Record) er
 		"msg":       rec.Formatted(calldepth + 1),
 	}
 
+	// Fields from a ModuleLogger become their own keys, without replacing
+	// any of the standard ones
+	for _, field := range RecordFields(rec) {
+		if _, ok := msg[field.Key]; ok {
+			continue
+		}
+		if err, ok := field.Value.(error); ok {
+			msg[field.Key] = err.Error()
+		} else {
+			msg[field.Key] = field.Value
+		}
+	}
+
 	return c.Send(msg)
 }
 
@@ -265,7 +279,7 @@ func (c *Client) Flush() error {
 
 	req.Header.Add("User-Agent", "eyethereal-go-loggly (version: "+Version+")")
 	req.Header.Add("Content-Type", "text/plain")
-	req.Header.Add("Content-Length", string(len(body)))
+	req.Header.Add("Content-Length", strconv.Itoa(len(body)))
 
 	tags := c.tagsList()
 	if tags != "" {
@@ -0,0 +1,212 @@
+package archercl
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/op/go-logging"
+)
+
+// A ModuleLogger has the same Printf style methods as the *logging.Logger
+// returned by Logger() but can also carry structured fields, like a request
+// ID or tenant, which are attached to every record it logs.
+//
+//	var log = archercl.NewModuleLogger("web")
+//
+//	func handle(w http.ResponseWriter, req *http.Request) {
+//		rlog := log.With("request", req.Header.Get("X-Request-Id"))
+//		rlog.Infof("Serving %s", req.URL.Path)
+//	}
+//
+// The fields show up wherever a format has %{fields} and as their own keys in
+// the JSON sent to loggly.
+type ModuleLogger struct {
+	module string
+	fields Fields
+
+	// A logger of our own so the extra call depth of the wrapper doesn't
+	// affect anyone else using the module
+	logger *logging.Logger
+}
+
+// Creates a ModuleLogger for a module, registering the module with Logger()
+// if it hasn't been already.
+func NewModuleLogger(module string) *ModuleLogger {
+	Logger(module)
+
+	lgr := logging.MustGetLogger(module)
+	lgr.ExtraCalldepth = 2
+
+	return &ModuleLogger{
+		module: module,
+		logger: lgr,
+	}
+}
+
+// Returns a new ModuleLogger with more fields given as alternating keys and
+// values. The original is not changed, so this is safe to call on a shared
+// logger.
+func (l *ModuleLogger) With(keyvals ...interface{}) *ModuleLogger {
+	l2 := *l
+	l2.fields = l.fields.With(keyvals...)
+	return &l2
+}
+
+// The name of the module this logs to
+func (l *ModuleLogger) Module() string {
+	return l.module
+}
+
+// The fields attached to every record from this logger
+func (l *ModuleLogger) Fields() Fields {
+	return l.fields
+}
+
+func (l *ModuleLogger) IsEnabledFor(level logging.Level) bool {
+	return l.logger.IsEnabledFor(level)
+}
+
+// Everything logged goes through here, which is why the logger has an
+// ExtraCalldepth of 2.
+func (l *ModuleLogger) logf(level logging.Level, format *string, args []interface{}) {
+	if len(l.fields) > 0 {
+		// The fields ride along as the last argument using an explicit
+		// index so that they don't change the message
+		if format == nil {
+			msg := strings.TrimSuffix(fmt.Sprintln(args...), "\n")
+			f := strings.Replace(msg, "%", "%%", -1)
+			format = &f
+			args = nil
+		}
+		f := *format + "%[" + strconv.Itoa(len(args)+1) + "]v"
+		format = &f
+		args = append(args[:len(args):len(args)], l.fields)
+	}
+
+	if format == nil {
+		switch level {
+		case logging.CRITICAL:
+			l.logger.Critical(args...)
+		case logging.ERROR:
+			l.logger.Error(args...)
+		case logging.WARNING:
+			l.logger.Warning(args...)
+		case logging.NOTICE:
+			l.logger.Notice(args...)
+		case logging.INFO:
+			l.logger.Info(args...)
+		default:
+			l.logger.Debug(args...)
+		}
+		return
+	}
+
+	switch level {
+	case logging.CRITICAL:
+		l.logger.Criticalf(*format, args...)
+	case logging.ERROR:
+		l.logger.Errorf(*format, args...)
+	case logging.WARNING:
+		l.logger.Warningf(*format, args...)
+	case logging.NOTICE:
+		l.logger.Noticef(*format, args...)
+	case logging.INFO:
+		l.logger.Infof(*format, args...)
+	default:
+		l.logger.Debugf(*format, args...)
+	}
+}
+
+// Fatal is equivalent to l.Critical(fmt.Sprint()) followed by a call to os.Exit(1).
+func (l *ModuleLogger) Fatal(args ...interface{}) {
+	l.logf(logging.CRITICAL, nil, args)
+	os.Exit(1)
+}
+
+// Fatalf is equivalent to l.Critical followed by a call to os.Exit(1).
+func (l *ModuleLogger) Fatalf(format string, args ...interface{}) {
+	l.logf(logging.CRITICAL, &format, args)
+	os.Exit(1)
+}
+
+// Panic is equivalent to l.Critical(fmt.Sprint()) followed by a call to panic().
+func (l *ModuleLogger) Panic(args ...interface{}) {
+	l.logf(logging.CRITICAL, nil, args)
+	panic(fmt.Sprint(args...))
+}
+
+// Panicf is equivalent to l.Critical followed by a call to panic().
+func (l *ModuleLogger) Panicf(format string, args ...interface{}) {
+	l.logf(logging.CRITICAL, &format, args)
+	panic(fmt.Sprintf(format, args...))
+}
+
+func (l *ModuleLogger) Critical(args ...interface{}) {
+	l.logf(logging.CRITICAL, nil, args)
+}
+
+func (l *ModuleLogger) Criticalf(format string, args ...interface{}) {
+	l.logf(logging.CRITICAL, &format, args)
+}
+
+func (l *ModuleLogger) Error(args ...interface{}) {
+	l.logf(logging.ERROR, nil, args)
+}
+
+func (l *ModuleLogger) Errorf(format string, args ...interface{}) {
+	l.logf(logging.ERROR, &format, args)
+}
+
+func (l *ModuleLogger) Warning(args ...interface{}) {
+	l.logf(logging.WARNING, nil, args)
+}
+
+func (l *ModuleLogger) Warningf(format string, args ...interface{}) {
+	l.logf(logging.WARNING, &format, args)
+}
+
+func (l *ModuleLogger) Notice(args ...interface{}) {
+	l.logf(logging.NOTICE, nil, args)
+}
+
+func (l *ModuleLogger) Noticef(format string, args ...interface{}) {
+	l.logf(logging.NOTICE, &format, args)
+}
+
+func (l *ModuleLogger) Info(args ...interface{}) {
+	l.logf(logging.INFO, nil, args)
+}
+
+func (l *ModuleLogger) Infof(format string, args ...interface{}) {
+	l.logf(logging.INFO, &format, args)
+}
+
+func (l *ModuleLogger) Debug(args ...interface{}) {
+	l.logf(logging.DEBUG, nil, args)
+}
+
+func (l *ModuleLogger) Debugf(format string, args ...interface{}) {
+	l.logf(logging.DEBUG, &format, args)
+}
+
+type moduleLoggerKey struct{}
+
+// Returns a copy of ctx that carries l, so code further down the call chain
+// can log with the same fields.
+func ContextWithLogger(ctx context.Context, l *ModuleLogger) context.Context {
+	return context.WithValue(ctx, moduleLoggerKey{}, l)
+}
+
+// Returns the ModuleLogger stored in ctx by ContextWithLogger, or def if there
+// isn't one.
+func LoggerFromContext(ctx context.Context, def *ModuleLogger) *ModuleLogger {
+	if ctx != nil {
+		if l, ok := ctx.Value(moduleLoggerKey{}).(*ModuleLogger); ok {
+			return l
+		}
+	}
+	return def
+}
@@ -0,0 +1,152 @@
+package archercl
+
+import (
+	"strings"
+
+	"github.com/op/go-logging"
+)
+
+// Module names can be hierarchical, using either dots or slashes, as in
+// "db.pool" or "http/client". A module without a setting of its own gets it
+// from the nearest ancestor that has one, so
+//
+//	logging modules {
+//		db level: warning
+//		"http.*" level: debug
+//	}
+//
+// puts "db.pool" and "db.pool.conn" at WARNING and everything under "http" at
+// DEBUG. At each step up the hierarchy an exact name wins over a pattern, and
+// among patterns the longest one that matches wins. In patterns * matches any
+// run of characters, separators included, and ? matches a single character.
+
+// Returns the module followed by each of its ancestors, nearest first, so
+// "db.pool/conn" gives "db.pool/conn", "db.pool", and "db".
+func ModuleAncestors(module string) []string {
+	out := []string{module}
+	for {
+		ix := strings.LastIndexAny(module, "./")
+		if ix <= 0 {
+			return out
+		}
+		module = module[:ix]
+		out = append(out, module)
+	}
+}
+
+// Reports if a module name is matched by pattern, which is either a plain
+// name or contains * or ? wildcards.
+func MatchModule(pattern, module string) bool {
+	return globMatch(pattern, module)
+}
+
+// Reports if module or any of its ancestors is matched by one of the patterns.
+func moduleInList(patterns []string, module string) bool {
+	for _, name := range ModuleAncestors(module) {
+		for _, p := range patterns {
+			if globMatch(p, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Finds the key in a set of module names and patterns that applies to a
+// module. keys are the candidate names, and has reports if a key actually has
+// the setting being looked for.
+func bestModuleKey(module string, keys []string, has func(string) bool) (string, bool) {
+	for _, name := range ModuleAncestors(module) {
+		for _, key := range keys {
+			if key == name && has(key) {
+				return key, true
+			}
+		}
+
+		best := ""
+		found := false
+		for _, key := range keys {
+			if !isPattern(key) || len(key) <= len(best) || !globMatch(key, name) || !has(key) {
+				continue
+			}
+			best = key
+			found = true
+		}
+		if found {
+			return best, true
+		}
+	}
+
+	return "", false
+}
+
+// Returns the child of a modules config node which has the setting named
+// child for module, taking the hierarchy and patterns into account.
+func moduleConfig(modules *AclNode, module string, child string) *AclNode {
+	if modules == nil {
+		return nil
+	}
+
+	key, ok := bestModuleKey(module, modules.OrderedChildNames, func(key string) bool {
+		return modules.Child(key, child) != nil
+	})
+	if !ok {
+		return nil
+	}
+	return modules.Child(key)
+}
+
+// Looks up the level for a module in a map of module names and patterns.
+func moduleLevelIn(levels map[string]logging.Level, module string) (logging.Level, bool) {
+	if len(levels) == 0 {
+		return 0, false
+	}
+
+	keys := make([]string, 0, len(levels))
+	for key := range levels {
+		keys = append(keys, key)
+	}
+
+	key, ok := bestModuleKey(module, keys, func(string) bool { return true })
+	if !ok {
+		return 0, false
+	}
+	return levels[key], true
+}
+
+func isPattern(s string) bool {
+	return strings.ContainsAny(s, "*?")
+}
+
+// A simple glob where * matches any run of characters and ? matches any one.
+func globMatch(pattern, s string) bool {
+	if !isPattern(pattern) {
+		return pattern == s
+	}
+
+	// Iterative matching that backtracks to the last * on a mismatch
+	p, i := 0, 0
+	star, mark := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star = p
+			mark = i
+			p++
+		case star >= 0:
+			p = star + 1
+			mark++
+			i = mark
+		default:
+			return false
+		}
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
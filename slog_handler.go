@@ -0,0 +1,275 @@
+package archercl
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/op/go-logging"
+)
+
+// The module used for slog records that don't name one
+const DEFAULT_SLOG_MODULE = "slog"
+
+// Options for a SlogHandler. Anything left empty comes from the "slog" block
+// inside of the logging config when the handler is created
+//
+//	logging {
+//		slog {
+//			moduleKey: "component"
+//			groupAsModule: true
+//			defaultModule: "app"
+//		}
+//	}
+type SlogOptions struct {
+	// The attribute that holds the module name. The default is "module". The
+	// attribute is used for the module instead of being part of the message.
+	ModuleKey string
+
+	// If set, groups from WithGroup are used as the module instead of as a
+	// prefix on the attribute keys. Nested groups are joined with dots, so
+	// logger.WithGroup("http").WithGroup("client") logs to "http.client".
+	GroupAsModule bool
+
+	// The module for records that don't have one. The default is
+	// DEFAULT_SLOG_MODULE.
+	DefaultModule string
+}
+
+// A SlogHandler is a log/slog Handler which sends everything through the
+// same backends, formats, and module levels as the loggers returned by
+// Logger(), so slog and go-logging code can share one logging config. The
+// attributes of a record are added to the end of the message as key=value
+// pairs. Format verbs about the caller, such as %{shortfunc}, show the handler
+// rather than the code that called slog.
+type SlogHandler struct {
+	opts   SlogOptions
+	module string
+	prefix string
+	attrs  string
+
+	// The logger for module, which is nil if the module came from an
+	// attribute rather than the code, see attrLogger.
+	lgr *logging.Logger
+}
+
+// Creates a new SlogHandler. opts may be nil to take everything from the
+// logging config.
+func NewSlogHandler(opts *SlogOptions) *SlogHandler {
+	h := &SlogHandler{}
+	if opts != nil {
+		h.opts = *opts
+	}
+
+	registryMutex.RLock()
+	node := loggingACL.Child("slog")
+	registryMutex.RUnlock()
+
+	if len(h.opts.ModuleKey) == 0 {
+		h.opts.ModuleKey = node.DefChildAsString("module", "moduleKey")
+	}
+	if !h.opts.GroupAsModule {
+		h.opts.GroupAsModule = node.ChildAsBool("groupAsModule")
+	}
+	if len(h.opts.DefaultModule) == 0 {
+		h.opts.DefaultModule = node.DefChildAsString(DEFAULT_SLOG_MODULE, "defaultModule")
+	}
+	h.lgr = Logger(h.moduleName())
+
+	return h
+}
+
+// Returns an slog.Logger which logs to module through a new SlogHandler. This
+// is the slog equivalent of Logger(module).
+func SlogLogger(module string) *slog.Logger {
+	h := NewSlogHandler(nil)
+	h.module = module
+	h.lgr = Logger(module)
+	return slog.New(h)
+}
+
+// Makes a SlogHandler the default for log/slog, which also sends anything
+// from the standard log package through it.
+func SetSlogDefault(opts *SlogOptions) {
+	slog.SetDefault(slog.New(NewSlogHandler(opts)))
+}
+
+// Converts a go-logging level to the closest slog level.
+func SlogLevel(level logging.Level) slog.Level {
+	switch level {
+	case logging.CRITICAL:
+		return slog.LevelError + 4
+	case logging.ERROR:
+		return slog.LevelError
+	case logging.WARNING:
+		return slog.LevelWarn
+	case logging.NOTICE:
+		return slog.LevelInfo + 2
+	case logging.INFO:
+		return slog.LevelInfo
+	}
+	return slog.LevelDebug
+}
+
+// Converts an slog level to a go-logging level. Levels in between the ones
+// slog defines are rounded down, so slog.LevelInfo+2 is NOTICE and anything
+// above slog.LevelError is CRITICAL.
+func LoggingLevel(level slog.Level) logging.Level {
+	switch {
+	case level > slog.LevelError:
+		return logging.CRITICAL
+	case level >= slog.LevelError:
+		return logging.ERROR
+	case level >= slog.LevelWarn:
+		return logging.WARNING
+	case level > slog.LevelInfo:
+		return logging.NOTICE
+	case level >= slog.LevelInfo:
+		return logging.INFO
+	}
+	return logging.DEBUG
+}
+
+func (h *SlogHandler) moduleName() string {
+	if len(h.module) > 0 {
+		return h.module
+	}
+	return h.opts.DefaultModule
+}
+
+// The module of a record isn't known until Handle sees its attributes, so
+// this only rules out levels that no module is configured for. Handle checks
+// the level for the record's module.
+func (h *SlogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return LoggingLevel(level) <= dispatcher.mostVerbose()
+}
+
+func (h *SlogHandler) Handle(ctx context.Context, r slog.Record) error {
+	module := h.moduleName()
+	lgr := h.lgr
+	if len(h.prefix) == 0 {
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == h.opts.ModuleKey {
+				module = a.Value.String()
+				lgr = nil
+			}
+			return true
+		})
+	}
+
+	level := LoggingLevel(r.Level)
+	if lgr == nil {
+		lgr = attrLogger(module, level)
+		if lgr == nil {
+			return nil
+		}
+	} else if !lgr.IsEnabledFor(level) {
+		return nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString(r.Message)
+	sb.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		if len(h.prefix) == 0 && a.Key == h.opts.ModuleKey {
+			return true
+		}
+		writeSlogAttr(&sb, h.prefix, a)
+		return true
+	})
+
+	logAt(lgr, level, sb.String())
+	return nil
+}
+
+func (h *SlogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+
+	var sb strings.Builder
+	sb.WriteString(h.attrs)
+	for _, a := range attrs {
+		if len(h.prefix) == 0 && a.Key == h.opts.ModuleKey {
+			h2.module = a.Value.String()
+			h2.lgr = nil
+			continue
+		}
+		writeSlogAttr(&sb, h.prefix, a)
+	}
+	h2.attrs = sb.String()
+
+	return &h2
+}
+
+func (h *SlogHandler) WithGroup(name string) slog.Handler {
+	if len(name) == 0 {
+		return h
+	}
+
+	h2 := *h
+	if h.opts.GroupAsModule {
+		if len(h.module) > 0 {
+			h2.module = h.module + "." + name
+		} else {
+			h2.module = name
+		}
+		h2.lgr = Logger(h2.module)
+	} else {
+		h2.prefix = h.prefix + name + "."
+	}
+
+	return &h2
+}
+
+// Returns a logger for a module named by an attribute, or nil if the module
+// doesn't log at level. Modules from attributes can be made up for every
+// request, so unless there is already a logger for one it isn't added to the
+// ones Logger keeps forever. It gets a throwaway logger instead and its level
+// is worked out from the logging config each time.
+func attrLogger(module string, level logging.Level) *logging.Logger {
+	registryMutex.RLock()
+	lgr := loggers[module]
+	enabled := true
+	if lgr == nil && loggingACL != nil {
+		_, gate := moduleLevel(module)
+		enabled = level <= gate
+	}
+	registryMutex.RUnlock()
+
+	if lgr == nil {
+		lgr = logging.MustGetLogger(module)
+	}
+	if !enabled || !lgr.IsEnabledFor(level) {
+		return nil
+	}
+	return lgr
+}
+
+// Adds an attribute as " key=value", with groups flattened into dotted keys.
+func writeSlogAttr(sb *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		if len(a.Key) > 0 {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			writeSlogAttr(sb, prefix, ga)
+		}
+		return
+	}
+
+	sb.WriteByte(' ')
+	sb.WriteString(prefix)
+	sb.WriteString(a.Key)
+	sb.WriteByte('=')
+
+	val := a.Value.String()
+	if len(val) == 0 || strings.ContainsAny(val, " =\"\t\n") {
+		val = strconv.Quote(val)
+	}
+	sb.WriteString(val)
+}
@@ -0,0 +1,130 @@
+package archercl
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/op/go-logging"
+)
+
+// The module used for the standard log package when the config doesn't
+// give one
+const DEFAULT_STDLIB_MODULE = "stdlib"
+
+// Lines longer than this are logged in pieces rather than held forever
+// waiting for a newline
+const MAX_WRITER_LINE = 64 * 1024
+
+type logWriter struct {
+	module string
+	level  logging.Level
+
+	mutex sync.Mutex
+	buf   []byte
+}
+
+// Returns an io.Writer for libraries that want somewhere to write their log
+// output. Every line written to it becomes a record for module at level, and
+// goes through the configured backends like anything else. A line without a
+// newline at the end is held until the rest of it is written.
+func WriterFor(module string, level logging.Level) io.Writer {
+	return &logWriter{
+		module: module,
+		level:  level,
+	}
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		ix := bytes.IndexByte(w.buf, '\n')
+		if ix < 0 {
+			if len(w.buf) < MAX_WRITER_LINE {
+				break
+			}
+			ix = MAX_WRITER_LINE
+		}
+
+		line := bytes.TrimRight(w.buf[:ix], "\r\n")
+		if len(line) > 0 {
+			logAt(Logger(w.module), w.level, string(line))
+		}
+
+		if ix < len(w.buf) && w.buf[ix] == '\n' {
+			ix++
+		}
+		w.buf = w.buf[ix:]
+	}
+
+	// Don't keep a large array around because of one long line
+	if len(w.buf) == 0 {
+		w.buf = nil
+	}
+
+	return len(p), nil
+}
+
+// Sends everything written with the standard log package to module at level.
+// The log flags are cleared since the time and so on come from the format of
+// each backend. The returned function puts the previous output and flags back.
+//
+// The same thing can be done from the config with
+//
+//	logging {
+//		stdlib {
+//			module: thirdparty
+//			level: info
+//		}
+//	}
+func RedirectStdLog(module string, level logging.Level) (restore func()) {
+	out := log.Writer()
+	flags := log.Flags()
+
+	log.SetOutput(WriterFor(module, level))
+	log.SetFlags(0)
+
+	return func() {
+		log.SetOutput(out)
+		log.SetFlags(flags)
+	}
+}
+
+// Undoes the redirect made for the last config that had a stdlib block.
+var stdlibMutex sync.Mutex
+var stdlibRestore func()
+
+// Redirects the standard log package according to the stdlib block in the
+// logging config. If the block has been removed since the last config the
+// original output is put back.
+func configureStdLog(node *AclNode) {
+	stdlibMutex.Lock()
+	defer stdlibMutex.Unlock()
+
+	if stdlibRestore != nil {
+		stdlibRestore()
+		stdlibRestore = nil
+	}
+
+	stdlib := node.Child("stdlib")
+	if stdlib == nil {
+		return
+	}
+
+	level := logging.INFO
+	ls := stdlib.ChildAsString("level")
+	if len(ls) > 0 {
+		var err error
+		level, err = logging.LogLevel(ls)
+		if err != nil {
+			logDelayed(logging.ERROR, "Did not understand stdlib log level '"+ls+"'")
+			level = logging.INFO
+		}
+	}
+
+	stdlibRestore = RedirectStdLog(stdlib.DefChildAsString(DEFAULT_STDLIB_MODULE, "module"), level)
+}
@@ -0,0 +1,459 @@
+package archercl
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+const (
+	SYSLOG_RFC5424 = "rfc5424"
+	SYSLOG_RFC3164 = "rfc3164"
+)
+
+// The go-logging levels mapped onto syslog severities
+var syslogSeverities = map[logging.Level]syslog.Priority{
+	logging.CRITICAL: syslog.LOG_CRIT,
+	logging.ERROR:    syslog.LOG_ERR,
+	logging.WARNING:  syslog.LOG_WARNING,
+	logging.NOTICE:   syslog.LOG_NOTICE,
+	logging.INFO:     syslog.LOG_INFO,
+	logging.DEBUG:    syslog.LOG_DEBUG,
+}
+
+// A RemoteSyslogBackend sends records to a syslog server over the network
+// instead of through the local syslog socket. Messages are written in either
+// RFC 5424 or the older BSD RFC 3164 format. Over udp each message is a single
+// datagram, while tcp and tls connections use octet counted framing as
+// described in RFC 6587.
+//
+// Logging only adds the message to a buffer of BufferSize entries, and a
+// goroutine does the connecting and writing, so a slow or dead server never
+// holds up the code that is logging. When the buffer is full the oldest
+// messages are dropped. The connection is made the first time something is
+// logged. If it can't be made, or is lost later, a new one is tried no more
+// often than ReconnectDelay, and a write that takes longer than WriteTimeout
+// counts as a lost connection.
+//
+// It is configured from a backend block like
+//
+//	remote {
+//		type: remoteSyslog
+//		network: tls          // udp (default), tcp, or tls
+//		address: "logs.example.com:6514"
+//		protocol: rfc5424     // or rfc3164
+//		facility: local0
+//		hostname: "web-1"     // Defaults to os.Hostname()
+//		appName: "myapp"      // Defaults to the program name
+//		bufferSize: 1000
+//		reconnectDelay: "5s"
+//		writeTimeout: "10s"
+//
+//		// Only used by rfc5424. Each child is an SD-ID with its parameters
+//		structuredData {
+//			"origin@32473" {
+//				env: production
+//			}
+//		}
+//
+//		// rootCAs alone verifies the server with those CAs instead of the
+//		// system ones. Adding cert and key sends a client certificate, see
+//		// AclNode.TLSConfig()
+//		tls {
+//			cert: "client.pem"
+//			key: "client.key"
+//			rootCAs: "ca.pem"
+//			serverName: "logs.example.com"
+//		}
+//	}
+type RemoteSyslogBackend struct {
+	Network  string
+	Address  string
+	Protocol string
+	Facility syslog.Priority
+
+	Hostname string
+	AppName  string
+
+	// Keyed by SD-ID, then by parameter name
+	StructuredData map[string]map[string]string
+
+	// Only used for the tls network
+	TLSConfig *tls.Config
+
+	BufferSize     int
+	ReconnectDelay time.Duration
+	WriteTimeout   time.Duration
+
+	mutex   sync.Mutex
+	pending [][]byte
+	dropped uint64
+
+	// The writer goroutine is running while stop isn't nil, and wake tells
+	// it there is something new in pending
+	stop chan struct{}
+	wake chan struct{}
+
+	// Only changed by the writer goroutine, but Close needs to see it
+	conn net.Conn
+}
+
+// The networks a RemoteSyslogBackend can use
+var remoteSyslogNetworks = map[string]bool{"udp": true, "tcp": true, "tls": true}
+
+// Creates a backend for the given network and address with reasonable
+// defaults for everything else, which can be changed before it is used.
+func NewRemoteSyslogBackend(network, address string) *RemoteSyslogBackend {
+	hostname, _ := os.Hostname()
+
+	return &RemoteSyslogBackend{
+		Network:        network,
+		Address:        address,
+		Protocol:       SYSLOG_RFC5424,
+		Facility:       syslog.LOG_USER,
+		Hostname:       hostname,
+		AppName:        filepath.Base(os.Args[0]),
+		StructuredData: make(map[string]map[string]string),
+		BufferSize:     1000,
+		ReconnectDelay: 5 * time.Second,
+		WriteTimeout:   10 * time.Second,
+	}
+}
+
+func (b *RemoteSyslogBackend) Log(level logging.Level, depth int, r *logging.Record) error {
+	msg := b.Message(level, r, r.Formatted(depth+1))
+
+	if b.Network != "udp" {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.pending = append(b.pending, msg)
+	if b.BufferSize > 0 && len(b.pending) > b.BufferSize {
+		b.dropped += uint64(len(b.pending) - b.BufferSize)
+		b.pending = b.pending[len(b.pending)-b.BufferSize:]
+	}
+
+	if b.stop == nil {
+		b.stop = make(chan struct{})
+		b.wake = make(chan struct{}, 1)
+		go b.run(b.stop, b.wake)
+	}
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// The number of messages waiting to be sent.
+func (b *RemoteSyslogBackend) Pending() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return len(b.pending)
+}
+
+// The number of messages dropped because the buffer was full.
+func (b *RemoteSyslogBackend) Dropped() uint64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.dropped
+}
+
+// The writer goroutine. It sends the oldest pending message until there
+// aren't any, connecting when it needs to, and stops when stop is closed.
+func (b *RemoteSyslogBackend) run(stop, wake chan struct{}) {
+	var lastAttempt time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		b.mutex.Lock()
+		var msg []byte
+		if len(b.pending) > 0 {
+			msg = b.pending[0]
+		}
+		conn := b.conn
+		b.mutex.Unlock()
+
+		if msg == nil {
+			select {
+			case <-wake:
+				continue
+			case <-stop:
+				return
+			}
+		}
+
+		if conn == nil {
+			if wait := b.ReconnectDelay - time.Since(lastAttempt); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-stop:
+					return
+				}
+			}
+			lastAttempt = time.Now()
+
+			var err error
+			conn, err = b.dial()
+			if err != nil {
+				continue
+			}
+
+			b.mutex.Lock()
+			select {
+			case <-stop:
+				// Closed while dialing
+				b.mutex.Unlock()
+				conn.Close()
+				return
+			default:
+			}
+			b.conn = conn
+			b.mutex.Unlock()
+		}
+
+		if b.WriteTimeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(b.WriteTimeout))
+		}
+		_, err := conn.Write(msg)
+
+		b.mutex.Lock()
+		if err != nil {
+			conn.Close()
+			if b.conn == conn {
+				b.conn = nil
+			}
+		} else if len(b.pending) > 0 && &b.pending[0][0] == &msg[0] {
+			// Unless it was dropped while being written
+			b.pending = b.pending[1:]
+		}
+		b.mutex.Unlock()
+	}
+}
+
+func (b *RemoteSyslogBackend) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+
+	switch b.Network {
+	case "tls":
+		return tls.DialWithDialer(dialer, "tcp", b.Address, b.TLSConfig)
+
+	case "udp", "tcp":
+		return dialer.Dial(b.Network, b.Address)
+	}
+
+	return nil, fmt.Errorf("Unknown network '%s' for remote syslog", b.Network)
+}
+
+// Stops the writer goroutine and closes any open connection. Anything still
+// pending stays buffered and a new connection will be made the next time
+// something is logged.
+func (b *RemoteSyslogBackend) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.stop != nil {
+		close(b.stop)
+		b.stop = nil
+		b.wake = nil
+	}
+
+	if b.conn == nil {
+		return nil
+	}
+
+	err := b.conn.Close()
+	b.conn = nil
+	return err
+}
+
+// Builds a single syslog message, without any transport framing, for the
+// record using the already formatted text of the message.
+func (b *RemoteSyslogBackend) Message(level logging.Level, r *logging.Record, text string) []byte {
+	var buf bytes.Buffer
+
+	pri := b.Facility | syslogSeverities[level]
+
+	if b.Protocol == SYSLOG_RFC3164 {
+		fmt.Fprintf(&buf, "<%d>%s %s %s[%d]: %s",
+			pri,
+			r.Time.Format(time.Stamp),
+			syslogHeaderField(b.Hostname, 255),
+			syslogHeaderField(b.AppName, 32),
+			os.Getpid(),
+			text)
+		return buf.Bytes()
+	}
+
+	fmt.Fprintf(&buf, "<%d>1 %s %s %s %d %s ",
+		pri,
+		r.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeaderField(b.Hostname, 255),
+		syslogHeaderField(b.AppName, 48),
+		os.Getpid(),
+		syslogHeaderField(r.Module, 32))
+
+	b.writeStructuredData(&buf)
+
+	if len(text) > 0 {
+		buf.WriteString(" ")
+		buf.WriteString(text)
+	}
+
+	return buf.Bytes()
+}
+
+func (b *RemoteSyslogBackend) writeStructuredData(buf *bytes.Buffer) {
+	if len(b.StructuredData) == 0 {
+		buf.WriteString("-")
+		return
+	}
+
+	// Sorted so the output is predictable
+	ids := make([]string, 0, len(b.StructuredData))
+	for id := range b.StructuredData {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		params := b.StructuredData[id]
+
+		names := make([]string, 0, len(params))
+		for name := range params {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		buf.WriteString("[")
+		buf.WriteString(syslogHeaderField(id, 32))
+		for _, name := range names {
+			fmt.Fprintf(buf, ` %s="%s"`, syslogHeaderField(name, 32), syslogParamEscaper.Replace(params[name]))
+		}
+		buf.WriteString("]")
+	}
+}
+
+var syslogParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// Header fields must be printable ASCII without spaces and have a maximum
+// length. An empty value is written as the NILVALUE.
+func syslogHeaderField(s string, max int) string {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s) && len(out) < max; i++ {
+		c := s[i]
+		if c > 32 && c < 127 && c != '=' && c != ']' && c != '"' {
+			out = append(out, c)
+		}
+	}
+
+	if len(out) == 0 {
+		return "-"
+	}
+	return string(out)
+}
+
+// Durations in the config can be strings like "5s" or plain numbers of seconds
+func childAsDuration(node *AclNode, def time.Duration, names ...string) time.Duration {
+	cNode := node.Child(names...)
+	if cNode.Len() == 0 {
+		return def
+	}
+
+	if str, ok := cNode.Values[len(cNode.Values)-1].(string); ok {
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			logDelayed(logging.ERROR, "Did not understand duration '"+str+"'")
+			return def
+		}
+		return d
+	}
+
+	return time.Duration(cNode.AsFloat() * float64(time.Second))
+}
+
+func makeRemoteSyslogBackend(node *AclNode) (logging.Backend, error) {
+	address := node.ChildAsString("address")
+	if len(address) == 0 {
+		return nil, fmt.Errorf("No address for remote syslog backend")
+	}
+
+	be := NewRemoteSyslogBackend(node.DefChildAsString("udp", "network"), address)
+	be.Protocol = node.DefChildAsString(be.Protocol, "protocol")
+	be.Hostname = node.DefChildAsString(be.Hostname, "hostname")
+	be.AppName = node.DefChildAsString(be.AppName, "appName")
+	be.BufferSize = node.DefChildAsInt(be.BufferSize, "bufferSize")
+	be.ReconnectDelay = childAsDuration(node, be.ReconnectDelay, "reconnectDelay")
+	be.WriteTimeout = childAsDuration(node, be.WriteTimeout, "writeTimeout")
+
+	if !remoteSyslogNetworks[be.Network] {
+		return nil, fmt.Errorf("Unknown network '%s' for remote syslog", be.Network)
+	}
+
+	if be.Protocol != SYSLOG_RFC5424 && be.Protocol != SYSLOG_RFC3164 {
+		return nil, fmt.Errorf("Unknown remote syslog protocol '%s'", be.Protocol)
+	}
+
+	fac := node.ChildAsString("facility")
+	if len(fac) > 0 {
+		facility, ok := SyslogFacilities[fac]
+		if !ok {
+			return nil, fmt.Errorf("Unknown syslog facility '%s'", fac)
+		}
+		be.Facility = facility
+	}
+
+	node.Child("structuredData").ForEachOrderedChild(func(id string, sd *AclNode) {
+		params := make(map[string]string)
+		sd.ForEachOrderedChild(func(name string, v *AclNode) {
+			params[name] = v.AsString()
+		})
+		be.StructuredData[id] = params
+	})
+
+	if be.Network == "tls" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+
+		tlsNode := node.Child("tls")
+		if len(tlsNode.ChildAsString(_CFG_CERT)) > 0 {
+			be.TLSConfig, err = tlsNode.TLSConfig()
+		} else {
+			be.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+
+			// Custom CAs for checking the server don't need a client cert
+			if caFile := tlsNode.ChildAsString(_CFG_ROOTCAS); len(caFile) > 0 {
+				be.TLSConfig.RootCAs, err = loadRootCAs(caFile)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to configure TLS for remote syslog: %s", err)
+		}
+		be.TLSConfig.ServerName = tlsNode.DefChildAsString(host, "serverName")
+	}
+
+	return be, nil
+}
@@ -81,16 +81,28 @@ func CreateTLSConfig(o *TLSConfigOptions) (c *tls.Config, err error) {
 		return nil, err
 	}
 
-	data, err := ioutil.ReadFile(o.RootCAsFilename)
+	c.RootCAs, err = loadRootCAs(o.RootCAsFilename)
 	if err != nil {
 		return nil, err
 	}
+	c.ClientCAs = c.RootCAs
 
-	if !c.RootCAs.AppendCertsFromPEM(data) {
-		return nil, errors.New("Unable to parse root CAs from " + o.RootCAsFilename)
+	return c, nil
+}
+
+// Reads a .pem file of CA certificates into a new pool
+func loadRootCAs(filename string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
 	}
 
-	return c, nil
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("Unable to parse root CAs from " + filename)
+	}
+
+	return pool, nil
 }
 
 func (self *AclNode) TLSConfigOptions() (*TLSConfigOptions, error) {